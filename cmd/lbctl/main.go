@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/internal/config"
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+const usage = `Usage: lbctl [flags] <command> [arguments]
+
+Commands:
+  list                      list servers
+  add <id> <address> [weight]
+                            add a server
+  remove <id>               remove a server immediately
+  drain <id> [timeout]      stop new requests, wait for in-flight ones, then remove
+  weight <id> <weight>      set a server's weight
+  state <id> <state>        set a server's state: active, draining or disabled
+  probes                    show the latest probe result per server
+  decisions                 stream selection decisions until interrupted
+  algorithm [name]          show or switch the algorithm: prequal or roundrobin
+  validate <file>           check a config file without contacting the admin API
+
+Flags:
+`
+
+type cli struct {
+	client *client
+	output string
+	out    io.Writer
+}
+
+func main() {
+	flags := flag.NewFlagSet("lbctl", flag.ExitOnError)
+	addr := flags.String("addr", envOr("LBCTL_ADDR", "localhost:9000"), "Admin API address")
+	pool := flags.String("pool", "", "Pool to manage, for servers with multiple pools")
+	output := flags.String("o", "table", "Output format: table or json")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "lbctl: unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c := &cli{client: newClient(*addr, *pool), output: *output, out: os.Stdout}
+	if err := c.run(flags.Arg(0), flags.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "lbctl:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (c *cli) run(command string, args []string) error {
+	switch command {
+	case "list", "ls":
+		return c.list(args)
+	case "add":
+		return c.add(args)
+	case "remove", "rm":
+		return c.remove(args)
+	case "drain":
+		return c.drain(args)
+	case "weight":
+		return c.weight(args)
+	case "state":
+		return c.state(args)
+	case "probes":
+		return c.probes(args)
+	case "decisions":
+		return c.decisions(args)
+	case "algorithm":
+		return c.algorithm(args)
+	case "validate":
+		return c.validate(args)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func expectArgs(args []string, minArgs, maxArgs int, synopsis string) error {
+	if len(args) < minArgs || len(args) > maxArgs {
+		return fmt.Errorf("usage: lbctl %s", synopsis)
+	}
+	return nil
+}
+
+func (c *cli) list(args []string) error {
+	if err := expectArgs(args, 0, 0, "list"); err != nil {
+		return err
+	}
+
+	var servers []loadbalancer.ServerInfo
+	if err := c.client.do("GET", "/servers", nil, &servers); err != nil {
+		return err
+	}
+	return c.print(servers, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tADDRESS\tHEALTHY\tSTATE\tWEIGHT\tRIF\tLATENCY")
+		for _, s := range servers {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%d\t%d\t%dms\n",
+				s.ID, s.Address, s.Healthy, s.State, s.Weight, s.RIF, s.Latency)
+		}
+	})
+}
+
+func (c *cli) add(args []string) error {
+	if err := expectArgs(args, 2, 3, "add <id> <address> [weight]"); err != nil {
+		return err
+	}
+
+	body := map[string]any{"id": args[0], "address": args[1]}
+	if len(args) == 3 {
+		weight, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid weight %q", args[2])
+		}
+		body["weight"] = weight
+	}
+
+	var server loadbalancer.ServerInfo
+	if err := c.client.do("POST", "/servers", body, &server); err != nil {
+		return err
+	}
+	return c.printServer(server)
+}
+
+func (c *cli) remove(args []string) error {
+	if err := expectArgs(args, 1, 1, "remove <id>"); err != nil {
+		return err
+	}
+	if err := c.client.do("DELETE", "/servers/"+url.PathEscape(args[0]), nil, nil); err != nil {
+		return err
+	}
+	return c.print(map[string]string{"removed": args[0]}, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Removed %s\n", args[0])
+	})
+}
+
+func (c *cli) drain(args []string) error {
+	if err := expectArgs(args, 1, 2, "drain <id> [timeout]"); err != nil {
+		return err
+	}
+
+	path := "/servers/" + url.PathEscape(args[0]) + "/drain"
+	if len(args) == 2 {
+		if _, err := time.ParseDuration(args[1]); err != nil {
+			return fmt.Errorf("invalid timeout %q", args[1])
+		}
+		path += "?timeout=" + url.QueryEscape(args[1])
+	}
+
+	var result struct {
+		ServerID string  `json:"server_id"`
+		Drained  bool    `json:"drained"`
+		Duration float64 `json:"duration_seconds"`
+	}
+	if err := c.client.do("POST", path, nil, &result); err != nil {
+		return err
+	}
+	return c.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Drained and removed %s in %s\n",
+			result.ServerID, time.Duration(result.Duration*float64(time.Second)).Round(time.Millisecond))
+	})
+}
+
+func (c *cli) weight(args []string) error {
+	if err := expectArgs(args, 2, 2, "weight <id> <weight>"); err != nil {
+		return err
+	}
+	weight, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid weight %q", args[1])
+	}
+
+	var server loadbalancer.ServerInfo
+	if err := c.client.do("PUT", "/servers/"+url.PathEscape(args[0])+"/weight", map[string]int{"weight": weight}, &server); err != nil {
+		return err
+	}
+	return c.printServer(server)
+}
+
+func (c *cli) state(args []string) error {
+	if err := expectArgs(args, 2, 2, "state <id> <active|draining|disabled>"); err != nil {
+		return err
+	}
+	state, err := loadbalancer.ParseServerState(args[1])
+	if err != nil {
+		return err
+	}
+
+	var server loadbalancer.ServerInfo
+	if err := c.client.do("PUT", "/servers/"+url.PathEscape(args[0])+"/state", map[string]loadbalancer.ServerState{"state": state}, &server); err != nil {
+		return err
+	}
+	return c.printServer(server)
+}
+
+func (c *cli) printServer(server loadbalancer.ServerInfo) error {
+	return c.print(server, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tADDRESS\tHEALTHY\tSTATE\tWEIGHT")
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%d\n", server.ID, server.Address, server.Healthy, server.State, server.Weight)
+	})
+}
+
+func (c *cli) probes(args []string) error {
+	if err := expectArgs(args, 0, 0, "probes"); err != nil {
+		return err
+	}
+
+	var pool map[string]loadbalancer.ProbeSnapshot
+	if err := c.client.do("GET", "/probes", nil, &pool); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(pool))
+	for id := range pool {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return c.print(pool, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "SERVER\tHEALTHY\tRIF\tLATENCY\tAGE\tUSES\tERROR")
+		for _, id := range ids {
+			p := pool[id]
+			age := time.Duration(p.Age * float64(time.Second)).Round(time.Millisecond)
+			fmt.Fprintf(w, "%s\t%t\t%d\t%dms\t%s\t%d\t%s\n", id, p.IsHealthy, p.RIF, p.Latency, age, p.Uses, p.Error)
+		}
+	})
+}
+
+// decisions streams decisions until the server closes the stream or the
+// command is interrupted. JSON output passes the lines through unchanged.
+func (c *cli) decisions(args []string) error {
+	if err := expectArgs(args, 0, 0, "decisions"); err != nil {
+		return err
+	}
+
+	resp, err := c.client.send("GET", "/decisions", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if c.output == "json" {
+			fmt.Fprintln(c.out, scanner.Text())
+			continue
+		}
+
+		var decision loadbalancer.Decision
+		if err := json.Unmarshal(scanner.Bytes(), &decision); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%s %s %s\n", decision.Time.Format(time.TimeOnly), decision.RequestID, decision.String())
+	}
+	return scanner.Err()
+}
+
+func (c *cli) algorithm(args []string) error {
+	if err := expectArgs(args, 0, 1, "algorithm [prequal|roundrobin]"); err != nil {
+		return err
+	}
+
+	var result map[string]string
+	var err error
+	if len(args) == 0 {
+		err = c.client.do("GET", "/algorithm", nil, &result)
+	} else {
+		err = c.client.do("PUT", "/algorithm", map[string]string{"algorithm": args[0]}, &result)
+	}
+	if err != nil {
+		return err
+	}
+	return c.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, result["algorithm"])
+	})
+}
+
+// validate loads and validates the config without building anything from
+// it, so no files are created and nothing is started. On top of what
+// config.Validate checks, it makes sure access log files can be created where
+// the config puts them, which the server would otherwise only find out at
+// startup. Every problem is listed, one per line.
+func (c *cli) validate(args []string) error {
+	if err := expectArgs(args, 1, 1, "validate <file>"); err != nil {
+		return err
+	}
+
+	cfg, err := config.ReadConfig(args[0])
+	if err != nil {
+		return err
+	}
+	cfg.SetDefaults()
+
+	var problems []string
+	if err := cfg.Validate(); err != nil {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, problem := range joined.Unwrap() {
+				problems = append(problems, problem.Error())
+			}
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+	problems = append(problems, checkAccessLogs(cfg)...)
+
+	if len(problems) > 0 {
+		c.print(map[string]any{"file": args[0], "valid": false, "errors": problems}, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "%s is invalid:\n", args[0])
+			for _, problem := range problems {
+				fmt.Fprintf(w, "  %s\n", problem)
+			}
+		})
+		return fmt.Errorf("%d problems in %s", len(problems), args[0])
+	}
+
+	return c.print(map[string]any{"file": args[0], "valid": true}, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "%s is valid\n", args[0])
+	})
+}
+
+// checkAccessLogs reports access log files whose directory doesn't exist.
+// The server opens them when it starts and logs without them if that fails.
+func checkAccessLogs(cfg *config.Config) []string {
+	type accessLog struct {
+		path string
+		log  *config.AccessLogConfig
+	}
+	logs := []accessLog{{"access_log", cfg.AccessLog}}
+	for i, pool := range cfg.Pools {
+		if pool.AccessLog != cfg.AccessLog {
+			logs = append(logs, accessLog{fmt.Sprintf("pools[%d].access_log", i), pool.AccessLog})
+		}
+	}
+
+	var problems []string
+	for _, l := range logs {
+		if l.log == nil || !l.log.Enabled || l.log.Output == "" || l.log.Output == "stdout" {
+			continue
+		}
+		dir := filepath.Dir(l.log.Output)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s.output: directory %s does not exist", l.path, dir))
+		}
+	}
+	return problems
+}
+
+// print writes v as indented JSON, or the table written by table.
+func (c *cli) print(v any, table func(w *tabwriter.Writer)) error {
+	if c.output == "json" {
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
@@ -3,16 +3,14 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/omarshaarawi/loadbalancer/internal/config"
+	"github.com/omarshaarawi/loadbalancer/internal/server"
 )
 
 const (
@@ -20,72 +18,137 @@ const (
 	LevelFatal = slog.Level(12)
 )
 
+// Settings are applied in order of precedence: flags, then LB_* environment
+// variables, then the config file, then defaults. Without -config the admin
+// API listens on localhost:9000 unless overridden. SIGHUP reloads the config
+// file, as does a change to it with -watch.
 func main() {
 	ctx := context.Background()
-	port := flag.String("port", "8080", "Port to listen on")
-	algorithm := flag.String("algorithm", "prequal", "Load balancing algorithm (prequal or roundrobin)")
+	configPath := flag.String("config", "", "Path to a JSON, YAML or TOML config file")
+	watch := flag.Duration("watch", 0, "Reload the config file when it changes, checking at this interval")
+	flag.String("port", "", "Port to listen on (default 8080)")
+	flag.String("admin-addr", "", "Address for the admin API, empty to disable")
+	flag.String("algorithm", "", "Load balancing algorithm (prequal or roundrobin)")
+	flag.Float64("qrif", 0, "RIF quantile above which a server is hot (default 0.84)")
+	flag.Int("selection-choices", 0, "Servers sampled per selection (default 2)")
+	flag.Duration("probe-interval", 0, "Time between probes (default 1s)")
+	flag.Duration("probe-timeout", 0, "Probe timeout (default the probe interval)")
+	flag.String("health-check-path", "", "Path probed on each server (default /health)")
+	flag.Duration("drain-timeout", 0, "How long servers removed by a reload are drained (default 30s)")
+	flag.String("servers", "", "Comma-separated id=address list replacing the configured servers")
 	flag.Parse()
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	algo := *algorithm
-	if envAlgo := os.Getenv("LB_ALGORITHM"); envAlgo != "" {
-		algo = envAlgo
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = cfg.Validate()
 	}
-
-	config := &loadbalancer.Config{
-		ProbeInterval:    time.Second,
-		ProbeTimeout:     time.Second * 2,
-		HealthCheckPath:  "/health",
-		SelectionChoices: 2,
-		Algorithm:        loadbalancer.Algorithm(algo),
+	if err != nil {
+		logger.Log(ctx, LevelFatal, "Invalid config",
+			slog.String("path", *configPath),
+			slog.String("error", err.Error()))
+		os.Exit(1)
 	}
 
-	lb := loadbalancer.NewLoadBalancer(config, logger)
-
-	logger.Info("Load balancer configured", slog.String("algorithm", string(config.Algorithm)))
-
-	testServers := []string{
-		"server1:80",
-		"server2:80",
-		"server3:80",
+	srv, err := server.NewServer(cfg, logger)
+	if err != nil {
+		logger.Log(ctx, LevelFatal, "Invalid config", slog.String("error", err.Error()))
+		os.Exit(1)
 	}
 
-	for i, addr := range testServers {
-		lb.AddServer(&loadbalancer.Server{
-			ID:        fmt.Sprintf("server-%d", i),
-			Address:   addr,
-			IsHealthy: true,
-		})
+	logger.Info("Load balancer configured",
+		slog.String("config", *configPath),
+		slog.String("algorithm", cfg.Algorithm),
+		slog.Int("servers", len(cfg.Servers)),
+		slog.Int("pools", len(cfg.Pools)))
+
+	reload := func() {
+		logger.Info("Reloading config", slog.String("path", *configPath))
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			logger.Error("Config reload failed, keeping the previous config",
+				slog.String("error", err.Error()))
+			return
+		}
+		srv.Reload(cfg)
 	}
 
-	lb.StartProbing()
-
-	mux := http.NewServeMux()
-	mux.Handle("/", lb)
-	mux.Handle("/metrics", promhttp.Handler())
-
-	server := &http.Server{
-		Addr:    ":" + *port,
-		Handler: mux,
+	if *configPath != "" && *watch > 0 {
+		go config.Watch(ctx, *configPath, *watch, reload)
 	}
 
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			reload()
+		}
+	}()
+
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 
-		logger.Info("Shutting down server...")
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
 
-		if err := server.Shutdown(ctx); err != nil {
+		if err := srv.Shutdown(ctx); err != nil {
 			logger.Error("Server shutdown error", slog.String("error", err.Error()))
 		}
 	}()
 
-	logger.Info("Starting server on port " + *port)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		logger.Log(ctx, LevelFatal, "Server error")
+	if err := srv.Start(); err != nil {
+		logger.Log(ctx, LevelFatal, "Server error", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads the config file, if any, applies the environment and
+// flags and fills in defaults. The result is not validated.
+func loadConfig(path string) (*config.Config, error) {
+	cfg := &config.Config{AdminAddr: "localhost:9000"}
+	if path != "" {
+		var err error
+		if cfg, err = config.ReadConfig(path); err != nil {
+			return nil, err
+		}
 	}
+	if err := cfg.ApplyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	applyFlags(cfg)
+	cfg.SetDefaults()
+	return cfg, nil
+}
+
+// applyFlags copies the flags given on the command line into cfg, leaving
+// fields whose flag was not given alone.
+func applyFlags(cfg *config.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		getter := f.Value.(flag.Getter)
+		switch f.Name {
+		case "port":
+			cfg.Port = f.Value.String()
+		case "admin-addr":
+			cfg.AdminAddr = f.Value.String()
+		case "algorithm":
+			cfg.Algorithm = f.Value.String()
+		case "qrif":
+			cfg.QRIF = getter.Get().(float64)
+		case "selection-choices":
+			cfg.SelectionChoices = getter.Get().(int)
+		case "probe-interval":
+			cfg.ProbeInterval = config.Duration(getter.Get().(time.Duration))
+		case "probe-timeout":
+			cfg.ProbeTimeout = config.Duration(getter.Get().(time.Duration))
+		case "drain-timeout":
+			cfg.DrainTimeout = config.Duration(getter.Get().(time.Duration))
+		case "health-check-path":
+			cfg.HealthCheckPath = f.Value.String()
+		case "servers":
+			cfg.Servers = config.ParseServers(f.Value.String())
+		}
+	})
 }
@@ -2,7 +2,11 @@ module github.com/omarshaarawi/loadbalancer
 
 go 1.24.2
 
-require github.com/prometheus/client_golang v1.23.2
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/prometheus/client_golang v1.23.2
+	go.yaml.in/yaml/v3 v3.0.4
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
@@ -1,65 +1,375 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
 )
 
 type Config struct {
-	Port         string        `json:"port"`
-	ReadTimeout  time.Duration `json:"read_timeout"`
-	WriteTimeout time.Duration `json:"write_timeout"`
+	Port         string   `json:"port"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+
+	ProbeInterval    Duration `json:"probe_interval"`
+	ProbeTimeout     Duration `json:"probe_timeout"`
+	HealthCheckPath  string   `json:"health_check_path"`
+	SelectionChoices int      `json:"selection_choices"`
+	Algorithm        string   `json:"algorithm"`
+	QRIF             float64  `json:"qrif"`
+
+	Servers      []ServerConfig `json:"servers"`
+	DrainTimeout Duration       `json:"drain_timeout"`
+	DNSRefresh   Duration       `json:"dns_refresh"`
 
-	ProbeInterval    time.Duration `json:"probe_interval"`
-	ProbeTimeout     time.Duration `json:"probe_timeout"`
-	HealthCheckPath  string        `json:"health_check_path"`
-	SelectionChoices int           `json:"selection_choices"`
+	Discovery []DiscoveryConfig `json:"discovery"`
 
-	Servers []ServerConfig `json:"servers"`
+	Pools  []PoolConfig  `json:"pools"`
+	Routes []RouteConfig `json:"routes"`
+
+	PolicyConfig
 
 	MetricsPort string `json:"metrics_port"`
+	AdminAddr   string `json:"admin_addr"`
 }
 
+// ServerConfig is a single server, or with Resolve set, a DNS name standing
+// for one server per address. With "dns" the Address host is resolved to
+// A/AAAA records; with "srv" Address is an SRV record name.
 type ServerConfig struct {
 	ID      string `json:"id"`
 	Address string `json:"address"`
 	Weight  int    `json:"weight"`
+	Resolve string `json:"resolve"`
+}
+
+type PoolConfig struct {
+	Name             string            `json:"name"`
+	Algorithm        string            `json:"algorithm"`
+	QRIF             float64           `json:"qrif"`
+	ProbeInterval    Duration          `json:"probe_interval"`
+	ProbeTimeout     Duration          `json:"probe_timeout"`
+	HealthCheckPath  string            `json:"health_check_path"`
+	SelectionChoices int               `json:"selection_choices"`
+	Servers          []ServerConfig    `json:"servers"`
+	Discovery        []DiscoveryConfig `json:"discovery"`
+
+	PolicyConfig
+}
+
+// DiscoveryConfig adds the servers listed by a service discovery provider:
+// with Type "file" the endpoint list in the file at Path, and with Type
+// "http" the one served at URL. Interval is how often the file is checked or
+// the URL polled. Wait turns on long polling of the URL.
+type DiscoveryConfig struct {
+	Type     string   `json:"type"`
+	Path     string   `json:"path"`
+	URL      string   `json:"url"`
+	Interval Duration `json:"interval"`
+	Wait     Duration `json:"wait"`
+}
+
+type RouteConfig struct {
+	Name        string            `json:"name"`
+	Host        string            `json:"host"`
+	PathPrefix  string            `json:"path_prefix"`
+	PathRegex   string            `json:"path_regex"`
+	Methods     []string          `json:"methods"`
+	Headers     map[string]string `json:"headers"`
+	Pool        string            `json:"pool"`
+	Splits      []SplitConfig     `json:"splits"`
+	SplitHeader string            `json:"split_header"`
+	SplitCookie string            `json:"split_cookie"`
+	Mirror      *MirrorConfig     `json:"mirror"`
+	StripPrefix bool              `json:"strip_prefix"`
+	RewritePath string            `json:"rewrite_path"`
+}
+
+type MirrorConfig struct {
+	Pool          string   `json:"pool"`
+	Percent       float64  `json:"percent"`
+	MaxBodyBytes  int64    `json:"max_body_bytes"`
+	MaxConcurrent int      `json:"max_concurrent"`
+	Timeout       Duration `json:"timeout"`
+}
+
+type SplitConfig struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// PolicyConfig holds the request handling sections, written at the top level
+// or in a pool. A missing section leaves the feature off, and a pool takes
+// every section it doesn't set from the top level.
+type PolicyConfig struct {
+	Admission        *AdmissionConfig        `json:"admission"`
+	ConcurrencyLimit *ConcurrencyLimitConfig `json:"concurrency_limit"`
+	Criticality      *CriticalityConfig      `json:"criticality"`
+	Timeouts         *TimeoutConfig          `json:"timeouts"`
+	Retry            *RetryConfig            `json:"retry"`
+	Sticky           *StickyConfig           `json:"sticky"`
+	Headers          *HeaderConfig           `json:"headers"`
+	Tracing          *TracingConfig          `json:"tracing"`
+	AccessLog        *AccessLogConfig        `json:"access_log"`
+	Debug            *DebugConfig            `json:"debug"`
+}
+
+// AdmissionConfig sheds requests to a backend over MaxRIF requests in flight
+// or MaxLatency. CriticalityFactors scales both limits per criticality class,
+// keyed by sheddable, default or critical. PriorityHeader names the header
+// carrying a low, normal or high priority, X-Priority by default.
+type AdmissionConfig struct {
+	Enabled            bool               `json:"enabled"`
+	MaxRIF             int32              `json:"max_rif"`
+	MaxLatency         Duration           `json:"max_latency"`
+	RetryAfter         Duration           `json:"retry_after"`
+	PriorityHeader     string             `json:"priority_header"`
+	CriticalityFactors map[string]float64 `json:"criticality_factors"`
+}
+
+// ConcurrencyLimitConfig turns on the adaptive concurrency limit with
+// Algorithm "gradient" or "aimd".
+type ConcurrencyLimitConfig struct {
+	Algorithm     string   `json:"algorithm"`
+	InitialLimit  int      `json:"initial_limit"`
+	MinLimit      int      `json:"min_limit"`
+	MaxLimit      int      `json:"max_limit"`
+	Smoothing     float64  `json:"smoothing"`
+	Backoff       float64  `json:"backoff"`
+	Timeout       Duration `json:"timeout"`
+	ResetInterval int      `json:"reset_interval"`
+	QueueTimeout  Duration `json:"queue_timeout"`
+}
+
+// CriticalityConfig classifies requests as sheddable, default or critical.
+type CriticalityConfig struct {
+	Header        string                   `json:"header"`
+	Default       string                   `json:"default"`
+	ReservedShare float64                  `json:"reserved_share"`
+	Routes        []CriticalityRouteConfig `json:"routes"`
+}
+
+type CriticalityRouteConfig struct {
+	PathPrefix  string `json:"path_prefix"`
+	PathRegex   string `json:"path_regex"`
+	Criticality string `json:"criticality"`
+}
+
+type TimeoutConfig struct {
+	Default        Duration             `json:"default"`
+	DeadlineHeader string               `json:"deadline_header"`
+	Routes         []TimeoutRouteConfig `json:"routes"`
+}
+
+type TimeoutRouteConfig struct {
+	PathPrefix string   `json:"path_prefix"`
+	Timeout    Duration `json:"timeout"`
+}
+
+type RetryConfig struct {
+	MaxRetries int `json:"max_retries"`
+}
+
+// StickyConfig pins clients to a server with a cookie, signed when Secret is
+// set.
+type StickyConfig struct {
+	Enabled    bool     `json:"enabled"`
+	CookieName string   `json:"cookie_name"`
+	Secret     string   `json:"secret"`
+	TTL        Duration `json:"ttl"`
+	Secure     bool     `json:"secure"`
+}
+
+// HeaderConfig holds the header rules. TrustedProxies lists the CIDR
+// prefixes or addresses of proxies whose forwarding headers are kept.
+type HeaderConfig struct {
+	InstanceID     string             `json:"instance_id"`
+	Request        []HeaderRuleConfig `json:"request"`
+	Response       []HeaderRuleConfig `json:"response"`
+	TrustedProxies []string           `json:"trusted_proxies"`
+}
+
+// HeaderRuleConfig adds, sets or removes a header. Value may use the
+// templates listed for loadbalancer.HeaderRule.
+type HeaderRuleConfig struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
 }
 
+type TracingConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Endpoint      string   `json:"endpoint"`
+	ServiceName   string   `json:"service_name"`
+	SampleRatio   float64  `json:"sample_ratio"`
+	BatchSize     int      `json:"batch_size"`
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+// AccessLogConfig writes an access log to Output, "stdout" or a file path.
+// MaxSize is in bytes.
+type AccessLogConfig struct {
+	Enabled          bool     `json:"enabled"`
+	Format           string   `json:"format"`
+	Output           string   `json:"output"`
+	MaxSize          int64    `json:"max_size"`
+	MaxAge           Duration `json:"max_age"`
+	MaxBackups       int      `json:"max_backups"`
+	SampleRate       float64  `json:"sample_rate"`
+	OnlySlowOrFailed bool     `json:"only_slow_or_failed"`
+	SlowThreshold    Duration `json:"slow_threshold"`
+}
+
+type DebugConfig struct {
+	Enabled bool   `json:"enabled"`
+	Header  string `json:"header"`
+	Log     bool   `json:"log"`
+}
+
+// LoadConfig reads the config file at path, fills in defaults and validates
+// it.
 func LoadConfig(path string) (*Config, error) {
-	file, err := os.Open(path)
+	config, err := ReadConfig(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	config.SetDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
 
-	config := &Config{}
-	if err := json.NewDecoder(file).Decode(config); err != nil {
+// ReadConfig reads the config file at path without filling in defaults, so
+// that overrides can be applied before pools inherit the top-level settings.
+// The format is chosen by extension: .yaml or .yml for YAML, .toml for TOML
+// and JSON otherwise. Unknown fields are rejected in every format.
+func ReadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
 
-	if config.Port == "" {
-		config.Port = "8080"
+	// YAML and TOML are converted to JSON so that every format is decoded
+	// with the same field names and the same strictness.
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err = yaml.Unmarshal(data, &doc); err == nil {
+			data, err = json.Marshal(doc)
+		}
+	case ".toml":
+		if _, err = toml.Decode(string(data), &doc); err == nil {
+			data, err = json.Marshal(doc)
+		}
 	}
-	if config.ReadTimeout == 0 {
-		config.ReadTimeout = 5 * time.Second
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
-	if config.WriteTimeout == 0 {
-		config.WriteTimeout = 10 * time.Second
+
+	config := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// SetDefaults fills in unset fields, and unset pool fields from the top-level
+// settings. The probe timeout defaults to 2s but never to more than the probe
+// interval, so with the default 1s interval it is 1s; a pool's default is the
+// top-level timeout capped at the pool's own interval.
+func (c *Config) SetDefaults() {
+	if c.Port == "" {
+		c.Port = "8080"
 	}
-	if config.ProbeInterval == 0 {
-		config.ProbeInterval = time.Second
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = Duration(5 * time.Second)
 	}
-	if config.ProbeTimeout == 0 {
-		config.ProbeTimeout = 2 * time.Second
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = Duration(10 * time.Second)
 	}
-	if config.HealthCheckPath == "" {
-		config.HealthCheckPath = "/health"
+	if c.ProbeInterval == 0 {
+		c.ProbeInterval = Duration(time.Second)
 	}
-	if config.SelectionChoices == 0 {
-		config.SelectionChoices = 2
+	if c.ProbeTimeout == 0 {
+		c.ProbeTimeout = min(Duration(2*time.Second), c.ProbeInterval)
+	}
+	if c.HealthCheckPath == "" {
+		c.HealthCheckPath = "/health"
+	}
+	if c.SelectionChoices == 0 {
+		c.SelectionChoices = 2
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = Duration(30 * time.Second)
+	}
+	if c.DNSRefresh == 0 {
+		c.DNSRefresh = Duration(30 * time.Second)
 	}
 
-	return config, nil
+	for i := range c.Pools {
+		pool := &c.Pools[i]
+		if pool.Algorithm == "" {
+			pool.Algorithm = c.Algorithm
+		}
+		if pool.QRIF == 0 {
+			pool.QRIF = c.QRIF
+		}
+		if pool.ProbeInterval == 0 {
+			pool.ProbeInterval = c.ProbeInterval
+		}
+		if pool.ProbeTimeout == 0 {
+			pool.ProbeTimeout = min(c.ProbeTimeout, pool.ProbeInterval)
+		}
+		if pool.HealthCheckPath == "" {
+			pool.HealthCheckPath = c.HealthCheckPath
+		}
+		if pool.SelectionChoices == 0 {
+			pool.SelectionChoices = c.SelectionChoices
+		}
+		pool.PolicyConfig.inherit(c.PolicyConfig)
+	}
+}
+
+// inherit fills in the sections p doesn't set from parent.
+func (p *PolicyConfig) inherit(parent PolicyConfig) {
+	if p.Admission == nil {
+		p.Admission = parent.Admission
+	}
+	if p.ConcurrencyLimit == nil {
+		p.ConcurrencyLimit = parent.ConcurrencyLimit
+	}
+	if p.Criticality == nil {
+		p.Criticality = parent.Criticality
+	}
+	if p.Timeouts == nil {
+		p.Timeouts = parent.Timeouts
+	}
+	if p.Retry == nil {
+		p.Retry = parent.Retry
+	}
+	if p.Sticky == nil {
+		p.Sticky = parent.Sticky
+	}
+	if p.Headers == nil {
+		p.Headers = parent.Headers
+	}
+	if p.Tracing == nil {
+		p.Tracing = parent.Tracing
+	}
+	if p.AccessLog == nil {
+		p.AccessLog = parent.AccessLog
+	}
+	if p.Debug == nil {
+		p.Debug = parent.Debug
+	}
 }
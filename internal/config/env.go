@@ -0,0 +1,77 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApplyEnv overrides fields from LB_* environment variables, looked up with
+// getenv. LB_SERVERS replaces the top-level servers, in the format read by
+// ParseServers.
+func (c *Config) ApplyEnv(getenv func(string) string) error {
+	var errs []error
+	str := func(key string, field *string) {
+		if value := getenv(key); value != "" {
+			*field = value
+		}
+	}
+	parse := func(key string, set func(string) error) {
+		if value := getenv(key); value != "" {
+			if err := set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid value %q", key, value))
+			}
+		}
+	}
+	duration := func(key string, field *Duration) {
+		parse(key, func(value string) error {
+			parsed, err := time.ParseDuration(value)
+			*field = Duration(parsed)
+			return err
+		})
+	}
+
+	str("LB_PORT", &c.Port)
+	str("LB_ADMIN_ADDR", &c.AdminAddr)
+	str("LB_ALGORITHM", &c.Algorithm)
+	str("LB_HEALTH_CHECK_PATH", &c.HealthCheckPath)
+	duration("LB_READ_TIMEOUT", &c.ReadTimeout)
+	duration("LB_WRITE_TIMEOUT", &c.WriteTimeout)
+	duration("LB_PROBE_INTERVAL", &c.ProbeInterval)
+	duration("LB_PROBE_TIMEOUT", &c.ProbeTimeout)
+	duration("LB_DRAIN_TIMEOUT", &c.DrainTimeout)
+	duration("LB_DNS_REFRESH", &c.DNSRefresh)
+	parse("LB_QRIF", func(value string) (err error) {
+		c.QRIF, err = strconv.ParseFloat(value, 64)
+		return err
+	})
+	parse("LB_SELECTION_CHOICES", func(value string) (err error) {
+		c.SelectionChoices, err = strconv.Atoi(value)
+		return err
+	})
+	if value := getenv("LB_SERVERS"); value != "" {
+		c.Servers = ParseServers(value)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ParseServers parses a comma-separated list of id=address entries. An entry
+// without an ID uses its address as the ID.
+func ParseServers(list string) []ServerConfig {
+	var servers []ServerConfig
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, address, found := strings.Cut(entry, "=")
+		if !found {
+			address = id
+		}
+		servers = append(servers, ServerConfig{ID: id, Address: address})
+	}
+	return servers
+}
@@ -0,0 +1,365 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+// FieldError is a problem with the field at Path, such as
+// "pools[1].servers[0].address".
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Validate checks the config after defaults have been applied and reports
+// every problem found, joined into one error of FieldErrors.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.balancer("", c.Algorithm, c.QRIF, c.SelectionChoices, c.ProbeInterval, c.ProbeTimeout)
+	v.servers("servers", c.Servers)
+	v.discovery("discovery", c.Discovery)
+	v.policy("", c.PolicyConfig, PolicyConfig{})
+	if c.DrainTimeout < 0 {
+		v.add("drain_timeout", "must not be negative")
+	}
+	if c.DNSRefresh < 0 {
+		v.add("dns_refresh", "must not be negative")
+	}
+
+	pools := make(map[string]bool)
+	for i, pool := range c.Pools {
+		path := fmt.Sprintf("pools[%d]", i)
+		switch {
+		case pool.Name == "":
+			v.add(path+".name", "is required")
+		case pools[pool.Name]:
+			v.add(path+".name", fmt.Sprintf("duplicate pool %q", pool.Name))
+		}
+		pools[pool.Name] = true
+
+		v.balancer(path+".", pool.Algorithm, pool.QRIF, pool.SelectionChoices, pool.ProbeInterval, pool.ProbeTimeout)
+		v.servers(path+".servers", pool.Servers)
+		v.discovery(path+".discovery", pool.Discovery)
+		v.policy(path+".", pool.PolicyConfig, c.PolicyConfig)
+	}
+
+	// Every pool opens its own access log, so two pools can't share a file.
+	files := make(map[string]string)
+	for i, pool := range c.Pools {
+		accessLog := pool.AccessLog
+		if accessLog == nil || !accessLog.Enabled || accessLog.Output == "" || accessLog.Output == "stdout" {
+			continue
+		}
+		if other, ok := files[accessLog.Output]; ok {
+			v.add(fmt.Sprintf("pools[%d].access_log.output", i),
+				fmt.Sprintf("%q is already the access log of pool %q", accessLog.Output, other))
+			continue
+		}
+		files[accessLog.Output] = pool.Name
+	}
+
+	// Routes send requests to pools, and a config without pools has none.
+	if len(c.Pools) == 0 && len(c.Routes) > 0 {
+		v.add("routes", "set without any pools")
+	}
+	for i, route := range c.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		switch {
+		case route.Pool == "" && len(route.Splits) == 0:
+			v.add(path+".pool", "is required without splits")
+		case route.Pool != "" && !pools[route.Pool]:
+			v.add(path+".pool", fmt.Sprintf("unknown pool %q", route.Pool))
+		}
+		if _, err := regexp.Compile(route.PathRegex); err != nil {
+			v.add(path+".path_regex", err.Error())
+		}
+
+		total := 0
+		for j, split := range route.Splits {
+			splitPath := fmt.Sprintf("%s.splits[%d]", path, j)
+			if !pools[split.Pool] {
+				v.add(splitPath+".pool", fmt.Sprintf("unknown pool %q", split.Pool))
+			}
+			if split.Weight < 0 {
+				v.add(splitPath+".weight", fmt.Sprintf("%d is negative", split.Weight))
+			}
+			total += split.Weight
+		}
+		if len(route.Splits) > 0 && total <= 0 {
+			v.add(path+".splits", "weights sum to zero")
+		}
+
+		if route.Mirror != nil {
+			if !pools[route.Mirror.Pool] {
+				v.add(path+".mirror.pool", fmt.Sprintf("unknown pool %q", route.Mirror.Pool))
+			}
+			if route.Mirror.Percent < 0 || route.Mirror.Percent > 100 {
+				v.add(path+".mirror.percent", fmt.Sprintf("%g is outside [0, 100]", route.Mirror.Percent))
+			}
+		}
+	}
+
+	return errors.Join(v.errs...)
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) add(path, message string) {
+	v.errs = append(v.errs, &FieldError{Path: path, Message: message})
+}
+
+// balancer checks the settings shared by the top level and pools. prefix is
+// empty for the top level.
+func (v *validator) balancer(prefix, algorithm string, qrif float64, choices int, interval, timeout Duration) {
+	switch loadbalancer.Algorithm(algorithm) {
+	case "", loadbalancer.AlgorithmPrequal, loadbalancer.AlgorithmRoundRobin:
+	default:
+		v.add(prefix+"algorithm", fmt.Sprintf("unknown algorithm %q", algorithm))
+	}
+	if qrif < 0 || qrif > 1 {
+		v.add(prefix+"qrif", fmt.Sprintf("%g is outside [0, 1]", qrif))
+	}
+	if choices < 1 {
+		v.add(prefix+"selection_choices", fmt.Sprintf("%d is less than 1", choices))
+	}
+	if interval <= 0 {
+		v.add(prefix+"probe_interval", "must be positive")
+	}
+	if timeout > interval {
+		v.add(prefix+"probe_timeout", fmt.Sprintf("%s is longer than the probe interval %s", timeout, interval))
+	}
+}
+
+func (v *validator) servers(path string, servers []ServerConfig) {
+	ids := make(map[string]bool)
+	for i, server := range servers {
+		serverPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case server.ID == "":
+			v.add(serverPath+".id", "is required")
+		case ids[server.ID]:
+			v.add(serverPath+".id", fmt.Sprintf("duplicate server ID %q", server.ID))
+		}
+		ids[server.ID] = true
+
+		switch server.Resolve {
+		case "", "dns":
+			if _, _, err := net.SplitHostPort(server.Address); err != nil {
+				v.add(serverPath+".address", fmt.Sprintf("invalid address %q: expected host:port", server.Address))
+			}
+		case "srv":
+			if server.Address == "" {
+				v.add(serverPath+".address", "is required")
+			}
+		default:
+			v.add(serverPath+".resolve", fmt.Sprintf("unknown value %q: expected dns or srv", server.Resolve))
+		}
+		if server.Weight < 0 {
+			v.add(serverPath+".weight", fmt.Sprintf("%d is negative", server.Weight))
+		}
+	}
+}
+
+func (v *validator) discovery(path string, discovery []DiscoveryConfig) {
+	for i, d := range discovery {
+		discoveryPath := fmt.Sprintf("%s[%d]", path, i)
+		switch d.Type {
+		case "file":
+			if d.Path == "" {
+				v.add(discoveryPath+".path", "is required")
+			}
+		case "http":
+			if u, err := url.Parse(d.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				v.add(discoveryPath+".url", fmt.Sprintf("invalid URL %q", d.URL))
+			}
+		default:
+			v.add(discoveryPath+".type", fmt.Sprintf("unknown type %q: expected file or http", d.Type))
+		}
+		if d.Interval < 0 {
+			v.add(discoveryPath+".interval", "must not be negative")
+		}
+		if d.Wait < 0 {
+			v.add(discoveryPath+".wait", "must not be negative")
+		}
+	}
+}
+
+// policy checks the request handling sections. A pool's sections taken from
+// the top level are the same as in parent and were already checked there.
+func (v *validator) policy(prefix string, p, parent PolicyConfig) {
+	if p.Admission != nil && p.Admission != parent.Admission {
+		v.admission(prefix+"admission", p.Admission)
+	}
+	if p.ConcurrencyLimit != nil && p.ConcurrencyLimit != parent.ConcurrencyLimit {
+		v.concurrencyLimit(prefix+"concurrency_limit", p.ConcurrencyLimit)
+	}
+	if p.Criticality != nil && p.Criticality != parent.Criticality {
+		v.criticality(prefix+"criticality", p.Criticality)
+	}
+	if p.Timeouts != nil && p.Timeouts != parent.Timeouts {
+		v.timeouts(prefix+"timeouts", p.Timeouts)
+	}
+	if p.Retry != nil && p.Retry != parent.Retry {
+		v.nonNegativeInt(prefix+"retry.max_retries", int64(p.Retry.MaxRetries))
+	}
+	if p.Sticky != nil && p.Sticky != parent.Sticky {
+		v.nonNegative(prefix+"sticky.ttl", p.Sticky.TTL)
+	}
+	if p.Headers != nil && p.Headers != parent.Headers {
+		v.headerRules(prefix+"headers.request", p.Headers.Request)
+		v.headerRules(prefix+"headers.response", p.Headers.Response)
+		for i, proxy := range p.Headers.TrustedProxies {
+			if _, err := loadbalancer.ParseTrustedProxy(proxy); err != nil {
+				v.add(fmt.Sprintf("%sheaders.trusted_proxies[%d]", prefix, i), fmt.Sprintf("invalid address or prefix %q", proxy))
+			}
+		}
+	}
+	if p.Tracing != nil && p.Tracing != parent.Tracing {
+		v.tracing(prefix+"tracing", p.Tracing)
+	}
+	if p.AccessLog != nil && p.AccessLog != parent.AccessLog {
+		v.accessLog(prefix+"access_log", p.AccessLog)
+	}
+}
+
+func (v *validator) nonNegative(path string, d Duration) {
+	if d < 0 {
+		v.add(path, "must not be negative")
+	}
+}
+
+func (v *validator) nonNegativeInt(path string, n int64) {
+	if n < 0 {
+		v.add(path, fmt.Sprintf("%d is negative", n))
+	}
+}
+
+func (v *validator) ratio(path string, value float64) {
+	if value < 0 || value > 1 {
+		v.add(path, fmt.Sprintf("%g is outside [0, 1]", value))
+	}
+}
+
+func (v *validator) criticalityName(path, value string) {
+	if value != "" && loadbalancer.ParseCriticality(value).String() != value {
+		v.add(path, fmt.Sprintf("unknown criticality %q: expected sheddable, default or critical", value))
+	}
+}
+
+func (v *validator) admission(path string, a *AdmissionConfig) {
+	v.nonNegativeInt(path+".max_rif", int64(a.MaxRIF))
+	v.nonNegative(path+".max_latency", a.MaxLatency)
+	v.nonNegative(path+".retry_after", a.RetryAfter)
+	for name, factor := range a.CriticalityFactors {
+		factorPath := fmt.Sprintf("%s.criticality_factors.%s", path, name)
+		if name == "" {
+			v.add(factorPath, "criticality is required")
+		}
+		v.criticalityName(factorPath, name)
+		if factor <= 0 {
+			v.add(factorPath, fmt.Sprintf("%g is not positive", factor))
+		}
+	}
+}
+
+func (v *validator) concurrencyLimit(path string, l *ConcurrencyLimitConfig) {
+	switch loadbalancer.LimitAlgorithm(l.Algorithm) {
+	case loadbalancer.LimitAlgorithmGradient, loadbalancer.LimitAlgorithmAIMD:
+	default:
+		v.add(path+".algorithm", fmt.Sprintf("unknown algorithm %q: expected gradient or aimd", l.Algorithm))
+	}
+	v.nonNegativeInt(path+".initial_limit", int64(l.InitialLimit))
+	v.nonNegativeInt(path+".min_limit", int64(l.MinLimit))
+	v.nonNegativeInt(path+".max_limit", int64(l.MaxLimit))
+	v.nonNegativeInt(path+".reset_interval", int64(l.ResetInterval))
+	if l.MinLimit > 0 && l.MaxLimit > 0 && l.MinLimit > l.MaxLimit {
+		v.add(path+".min_limit", fmt.Sprintf("%d is more than max_limit %d", l.MinLimit, l.MaxLimit))
+	}
+	v.ratio(path+".smoothing", l.Smoothing)
+	if l.Backoff < 0 || l.Backoff >= 1 {
+		v.add(path+".backoff", fmt.Sprintf("%g is outside [0, 1)", l.Backoff))
+	}
+	v.nonNegative(path+".timeout", l.Timeout)
+	v.nonNegative(path+".queue_timeout", l.QueueTimeout)
+}
+
+func (v *validator) criticality(path string, c *CriticalityConfig) {
+	v.criticalityName(path+".default", c.Default)
+	if c.ReservedShare < 0 || c.ReservedShare >= 1 {
+		v.add(path+".reserved_share", fmt.Sprintf("%g is outside [0, 1)", c.ReservedShare))
+	}
+	for i, route := range c.Routes {
+		routePath := fmt.Sprintf("%s.routes[%d]", path, i)
+		if route.PathPrefix == "" && route.PathRegex == "" {
+			v.add(routePath, "needs a path_prefix or path_regex")
+		}
+		if _, err := regexp.Compile(route.PathRegex); err != nil {
+			v.add(routePath+".path_regex", err.Error())
+		}
+		v.criticalityName(routePath+".criticality", route.Criticality)
+	}
+}
+
+func (v *validator) timeouts(path string, t *TimeoutConfig) {
+	v.nonNegative(path+".default", t.Default)
+	for i, route := range t.Routes {
+		routePath := fmt.Sprintf("%s.routes[%d]", path, i)
+		if route.PathPrefix == "" {
+			v.add(routePath+".path_prefix", "is required")
+		}
+		if route.Timeout <= 0 {
+			v.add(routePath+".timeout", "must be positive")
+		}
+	}
+}
+
+func (v *validator) headerRules(path string, rules []HeaderRuleConfig) {
+	for i, rule := range rules {
+		rulePath := fmt.Sprintf("%s[%d]", path, i)
+		switch loadbalancer.HeaderAction(rule.Action) {
+		case loadbalancer.HeaderAdd, loadbalancer.HeaderSet, loadbalancer.HeaderRemove:
+		default:
+			v.add(rulePath+".action", fmt.Sprintf("unknown action %q: expected add, set or remove", rule.Action))
+		}
+		if rule.Name == "" {
+			v.add(rulePath+".name", "is required")
+		}
+	}
+}
+
+func (v *validator) tracing(path string, t *TracingConfig) {
+	if t.Endpoint != "" {
+		if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(path+".endpoint", fmt.Sprintf("invalid URL %q", t.Endpoint))
+		}
+	}
+	v.ratio(path+".sample_ratio", t.SampleRatio)
+	v.nonNegativeInt(path+".batch_size", int64(t.BatchSize))
+	v.nonNegative(path+".flush_interval", t.FlushInterval)
+}
+
+func (v *validator) accessLog(path string, a *AccessLogConfig) {
+	switch loadbalancer.AccessLogFormat(a.Format) {
+	case "", loadbalancer.AccessLogJSON, loadbalancer.AccessLogLogfmt, loadbalancer.AccessLogCombined:
+	default:
+		v.add(path+".format", fmt.Sprintf("unknown format %q: expected json, logfmt or combined", a.Format))
+	}
+	v.nonNegativeInt(path+".max_size", a.MaxSize)
+	v.nonNegativeInt(path+".max_backups", int64(a.MaxBackups))
+	v.nonNegative(path+".max_age", a.MaxAge)
+	v.ratio(path+".sample_rate", a.SampleRate)
+	v.nonNegative(path+".slow_threshold", a.SlowThreshold)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/internal/config"
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+// Reload applies cfg, with defaults already filled in, to the running server
+// without dropping connections. Each pool's servers, algorithm, selection and
+// probing settings are changed in place and in one step, so a request sees a
+// pool either entirely before or entirely after the reload: unchanged servers
+// keep their RIF and probe results, and removed servers are drained. Pools
+// are updated one after another. Adding, removing or renaming pools and
+// changing routes or the request handling sections need a restart, so such a
+// config is rejected along with one that fails validation, and the previous
+// config stays in effect. Listener settings, the DNS refresh interval and
+// service discovery providers also need a restart and are ignored.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	err := cfg.Validate()
+	if err == nil {
+		err = s.checkReloadable(cfg)
+	}
+	if err != nil {
+		s.logger.Error("Config reload rejected, keeping the previous config",
+			slog.String("error", err.Error()))
+		return err
+	}
+
+	if err := s.apply(cfg); err != nil {
+		s.logger.Error("Config reload failed, rolling back",
+			slog.String("error", err.Error()))
+		if rollbackErr := s.apply(s.config); rollbackErr != nil {
+			s.logger.Error("Config rollback failed",
+				slog.String("error", rollbackErr.Error()))
+		}
+		return err
+	}
+
+	s.config = cfg
+	s.logger.Info("Config reloaded")
+	return nil
+}
+
+func (s *Server) checkReloadable(cfg *config.Config) error {
+	var errs []error
+
+	current := poolConfigs(s.config)
+	next := poolConfigs(cfg)
+	names := func(pools []config.PoolConfig) []string {
+		names := make([]string, 0, len(pools))
+		for _, pool := range pools {
+			names = append(names, pool.Name)
+		}
+		return names
+	}
+	if !reflect.DeepEqual(names(current), names(next)) {
+		errs = append(errs, fmt.Errorf("pools changed from %v to %v, which needs a restart", names(current), names(next)))
+	}
+	if !reflect.DeepEqual(s.config.Routes, cfg.Routes) {
+		errs = append(errs, errors.New("routes changed, which needs a restart"))
+	}
+	for i := range min(len(current), len(next)) {
+		if !reflect.DeepEqual(current[i].Discovery, next[i].Discovery) {
+			s.logger.Warn("Service discovery settings changed and will apply after a restart",
+				slog.String("pool", next[i].Name))
+		}
+		if !reflect.DeepEqual(current[i].PolicyConfig, next[i].PolicyConfig) {
+			errs = append(errs, fmt.Errorf("request handling settings of pool %s changed, which needs a restart", next[i].Name))
+		}
+	}
+
+	if s.config.Port != cfg.Port || s.config.AdminAddr != cfg.AdminAddr ||
+		s.config.ReadTimeout != cfg.ReadTimeout || s.config.WriteTimeout != cfg.WriteTimeout ||
+		s.config.DNSRefresh != cfg.DNSRefresh {
+		s.logger.Warn("Listener and DNS refresh settings changed and will apply after a restart")
+	}
+
+	return errors.Join(errs...)
+}
+
+// apply makes every pool match cfg, each in one step. cfg has been
+// validated, so a pool can only fail when one of its servers has the ID of a
+// server from another source, and the pools before it are then already
+// updated.
+func (s *Server) apply(cfg *config.Config) error {
+	var errs []error
+	for _, poolCfg := range poolConfigs(cfg) {
+		if err := s.applyPool(poolCfg, time.Duration(cfg.DrainTimeout)); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", poolCfg.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) applyPool(poolCfg config.PoolConfig, drainTimeout time.Duration) error {
+	diff, err := s.router.Pool(poolCfg.Name).Reconfigure(loadbalancer.PoolSettings{
+		Algorithm:        loadbalancer.Algorithm(poolCfg.Algorithm),
+		SelectionChoices: poolCfg.SelectionChoices,
+		QRIF:             poolCfg.QRIF,
+		ProbeInterval:    time.Duration(poolCfg.ProbeInterval),
+		ProbeTimeout:     time.Duration(poolCfg.ProbeTimeout),
+		HealthCheckPath:  poolCfg.HealthCheckPath,
+	}, "", newServers(poolCfg), drainTimeout)
+	if err != nil {
+		return err
+	}
+	s.discovery[poolCfg.Name].SetTargets(dnsTargets(poolCfg))
+	if !diff.Empty() {
+		s.logger.Info("Servers changed",
+			slog.String("pool", poolCfg.Name),
+			slog.Any("added", diff.Added),
+			slog.Any("removed", diff.Removed),
+			slog.Any("replaced", diff.Replaced),
+			slog.Any("updated", diff.Updated))
+	}
+	return nil
+}
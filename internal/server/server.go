@@ -2,61 +2,431 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/omarshaarawi/loadbalancer/internal/config"
 	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Server struct {
-	httpServer *http.Server
-	lb         *loadbalancer.LoadBalancer
-	config     *config.Config
-	logger     *slog.Logger
-	wg         sync.WaitGroup
+	httpServer  *http.Server
+	adminServer *http.Server
+	router      *loadbalancer.Router
+	discovery   map[string]*loadbalancer.DNSDiscovery
+	ctx         context.Context
+	stop        context.CancelFunc
+	config      *config.Config
+	logger      *slog.Logger
+	wg          sync.WaitGroup
+	reloadMutex sync.Mutex
 }
 
-func NewServer(cfg *config.Config, logger *slog.Logger) *Server {
-	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+func NewServer(cfg *config.Config, logger *slog.Logger) (*Server, error) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	router, err := newRouter(cfg, registry, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", router)
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/health", handleHealth)
+	mux.Handle("/status", poolsHandler(router, (*loadbalancer.LoadBalancer).Stats))
+	mux.Handle("/debug/probes", poolsHandler(router, (*loadbalancer.LoadBalancer).ProbePool))
+
+	s := &Server{
+		httpServer: &http.Server{
+			Addr:         ":" + cfg.Port,
+			Handler:      mux,
+			ReadTimeout:  time.Duration(cfg.ReadTimeout),
+			WriteTimeout: time.Duration(cfg.WriteTimeout),
+		},
+		router:    router,
+		discovery: make(map[string]*loadbalancer.DNSDiscovery),
+		config:    cfg,
+		logger:    logger,
+	}
+
+	// ctx stops discovery on shutdown.
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	for _, poolCfg := range poolConfigs(cfg) {
+		s.discovery[poolCfg.Name] = loadbalancer.NewDNSDiscovery(router.Pool(poolCfg.Name), dnsTargets(poolCfg), loadbalancer.DNSConfig{
+			Refresh:      time.Duration(cfg.DNSRefresh),
+			DrainTimeout: time.Duration(cfg.DrainTimeout),
+		})
+	}
+
+	if cfg.AdminAddr != "" {
+		s.adminServer = &http.Server{
+			Addr:    cfg.AdminAddr,
+			Handler: adminHandler(router),
+		}
+	}
+
+	return s, nil
+}
+
+// adminHandler serves each pool's admin API under /pools/{pool}/ and lists
+// the pools at /pools. The default pool's API is also served at the root, so
+// a config without pools can be managed like a single load balancer.
+func adminHandler(router *loadbalancer.Router) http.Handler {
+	mux := http.NewServeMux()
+	if lb := router.Pool("default"); lb != nil {
+		mux.Handle("/", lb.AdminHandler())
+	}
+	mux.HandleFunc("GET /pools", func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0)
+		for name := range router.Pools() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+	})
+	mux.HandleFunc("/pools/{pool}/", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("pool")
+		lb := router.Pool(name)
+		if lb == nil {
+			http.Error(w, "Unknown pool", http.StatusNotFound)
+			return
+		}
+		http.StripPrefix("/pools/"+name, lb.AdminHandler()).ServeHTTP(w, r)
+	})
+	return mux
+}
+
+// newRouter builds one pool per configured pool. A config without pools gets
+// a single "default" pool from the top-level settings that serves every path.
+func newRouter(cfg *config.Config, registry prometheus.Registerer, logger *slog.Logger) (*loadbalancer.Router, error) {
+	router := loadbalancer.NewRouter(logger)
+
+	for _, poolCfg := range poolConfigs(cfg) {
+		lb, err := newPool(poolCfg, registry, logger)
+		if err != nil {
+			return nil, err
+		}
+		router.AddPool(poolCfg.Name, lb)
+	}
+	if len(cfg.Pools) == 0 {
+		return router, router.AddRoute(loadbalancer.Route{Name: "default", Pool: "default"})
+	}
+
+	for _, routeCfg := range cfg.Routes {
+		splits := make([]loadbalancer.Split, 0, len(routeCfg.Splits))
+		for _, splitCfg := range routeCfg.Splits {
+			splits = append(splits, loadbalancer.Split{Pool: splitCfg.Pool, Weight: splitCfg.Weight})
+		}
+
+		var mirror *loadbalancer.MirrorConfig
+		if routeCfg.Mirror != nil {
+			mirror = &loadbalancer.MirrorConfig{
+				Pool:          routeCfg.Mirror.Pool,
+				Percent:       routeCfg.Mirror.Percent,
+				MaxBodyBytes:  routeCfg.Mirror.MaxBodyBytes,
+				MaxConcurrent: routeCfg.Mirror.MaxConcurrent,
+				Timeout:       time.Duration(routeCfg.Mirror.Timeout),
+			}
+		}
+
+		err := router.AddRoute(loadbalancer.Route{
+			Name: routeCfg.Name,
+			Match: loadbalancer.RouteMatch{
+				Host:       routeCfg.Host,
+				PathPrefix: routeCfg.PathPrefix,
+				PathRegex:  routeCfg.PathRegex,
+				Methods:    routeCfg.Methods,
+				Headers:    routeCfg.Headers,
+			},
+			Pool:   routeCfg.Pool,
+			Splits: splits,
+			SplitKey: loadbalancer.SplitKey{
+				Header: routeCfg.SplitHeader,
+				Cookie: routeCfg.SplitCookie,
+			},
+			Mirror:      mirror,
+			StripPrefix: routeCfg.StripPrefix,
+			RewritePath: routeCfg.RewritePath,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return router, nil
+}
+
+// poolConfigs returns the configured pools, or a single "default" pool from
+// the top-level settings for a config without pools.
+func poolConfigs(cfg *config.Config) []config.PoolConfig {
+	if len(cfg.Pools) > 0 {
+		return cfg.Pools
+	}
+	return []config.PoolConfig{{
+		Name:             "default",
+		Algorithm:        cfg.Algorithm,
+		QRIF:             cfg.QRIF,
 		ProbeInterval:    cfg.ProbeInterval,
 		ProbeTimeout:     cfg.ProbeTimeout,
 		HealthCheckPath:  cfg.HealthCheckPath,
 		SelectionChoices: cfg.SelectionChoices,
-	}, logger)
+		Servers:          cfg.Servers,
+		Discovery:        cfg.Discovery,
+		PolicyConfig:     cfg.PolicyConfig,
+	}}
+}
+
+func newPool(poolCfg config.PoolConfig, registry prometheus.Registerer, logger *slog.Logger) (*loadbalancer.LoadBalancer, error) {
+	lbConfig := &loadbalancer.Config{
+		ProbeInterval:    time.Duration(poolCfg.ProbeInterval),
+		ProbeTimeout:     time.Duration(poolCfg.ProbeTimeout),
+		HealthCheckPath:  poolCfg.HealthCheckPath,
+		SelectionChoices: poolCfg.SelectionChoices,
+		Algorithm:        loadbalancer.Algorithm(poolCfg.Algorithm),
+		QRIF:             poolCfg.QRIF,
+		// Split and mirror metrics already have a "pool" label for the
+		// target pool.
+		Metrics: loadbalancer.MetricsConfig{
+			Registerer:  registry,
+			ConstLabels: prometheus.Labels{"lb_pool": poolCfg.Name},
+		},
+	}
+	applyPolicy(lbConfig, poolCfg.PolicyConfig)
+	lb := loadbalancer.NewLoadBalancer(lbConfig, logger.With(slog.String("pool", poolCfg.Name)))
+
+	for _, server := range newServers(poolCfg) {
+		if err := lb.AddServer(server); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", poolCfg.Name, err)
+		}
+	}
 
-	for _, serverCfg := range cfg.Servers {
-		lb.AddServer(&loadbalancer.Server{
+	return lb, nil
+}
+
+// applyPolicy copies the request handling sections that are set onto
+// lbConfig.
+func applyPolicy(lbConfig *loadbalancer.Config, policy config.PolicyConfig) {
+	if a := policy.Admission; a != nil {
+		var factors map[loadbalancer.Criticality]float64
+		if len(a.CriticalityFactors) > 0 {
+			factors = loadbalancer.DefaultCriticalityFactors()
+			for name, factor := range a.CriticalityFactors {
+				factors[loadbalancer.ParseCriticality(name)] = factor
+			}
+		}
+		lbConfig.Admission = loadbalancer.AdmissionConfig{
+			Enabled:            a.Enabled,
+			MaxRIF:             a.MaxRIF,
+			MaxLatency:         time.Duration(a.MaxLatency),
+			RetryAfter:         time.Duration(a.RetryAfter),
+			PriorityHeader:     a.PriorityHeader,
+			CriticalityFactors: factors,
+		}
+	}
+	if l := policy.ConcurrencyLimit; l != nil {
+		lbConfig.ConcurrencyLimit = loadbalancer.ConcurrencyLimitConfig{
+			Algorithm:     loadbalancer.LimitAlgorithm(l.Algorithm),
+			InitialLimit:  l.InitialLimit,
+			MinLimit:      l.MinLimit,
+			MaxLimit:      l.MaxLimit,
+			Smoothing:     l.Smoothing,
+			Backoff:       l.Backoff,
+			Timeout:       time.Duration(l.Timeout),
+			ResetInterval: l.ResetInterval,
+			QueueTimeout:  time.Duration(l.QueueTimeout),
+		}
+	}
+	if c := policy.Criticality; c != nil {
+		routes := make([]loadbalancer.CriticalityRoute, 0, len(c.Routes))
+		for _, route := range c.Routes {
+			routes = append(routes, loadbalancer.CriticalityRoute{
+				PathPrefix:  route.PathPrefix,
+				PathRegex:   route.PathRegex,
+				Criticality: loadbalancer.ParseCriticality(route.Criticality),
+			})
+		}
+		lbConfig.Criticality = loadbalancer.CriticalityConfig{
+			Header:        c.Header,
+			Routes:        routes,
+			Default:       loadbalancer.ParseCriticality(c.Default),
+			ReservedShare: c.ReservedShare,
+		}
+	}
+	if t := policy.Timeouts; t != nil {
+		routes := make([]loadbalancer.TimeoutRoute, 0, len(t.Routes))
+		for _, route := range t.Routes {
+			routes = append(routes, loadbalancer.TimeoutRoute{PathPrefix: route.PathPrefix, Timeout: time.Duration(route.Timeout)})
+		}
+		lbConfig.Timeouts = loadbalancer.TimeoutConfig{
+			Default:        time.Duration(t.Default),
+			Routes:         routes,
+			DeadlineHeader: t.DeadlineHeader,
+		}
+	}
+	if r := policy.Retry; r != nil {
+		lbConfig.Retry = loadbalancer.RetryConfig{MaxRetries: r.MaxRetries}
+	}
+	if s := policy.Sticky; s != nil {
+		lbConfig.Sticky = loadbalancer.StickyConfig{
+			Enabled:    s.Enabled,
+			CookieName: s.CookieName,
+			Secret:     []byte(s.Secret),
+			TTL:        time.Duration(s.TTL),
+			Secure:     s.Secure,
+		}
+	}
+	if h := policy.Headers; h != nil {
+		lbConfig.Headers = loadbalancer.HeaderConfig{
+			Request:    headerRules(h.Request),
+			Response:   headerRules(h.Response),
+			InstanceID: h.InstanceID,
+		}
+		for _, proxy := range h.TrustedProxies {
+			// Validate has rejected prefixes that don't parse.
+			if prefix, err := loadbalancer.ParseTrustedProxy(proxy); err == nil {
+				lbConfig.Headers.TrustedProxies = append(lbConfig.Headers.TrustedProxies, prefix)
+			}
+		}
+	}
+	if t := policy.Tracing; t != nil {
+		lbConfig.Tracing = loadbalancer.TracingConfig{
+			Enabled:       t.Enabled,
+			Endpoint:      t.Endpoint,
+			ServiceName:   t.ServiceName,
+			SampleRatio:   t.SampleRatio,
+			BatchSize:     t.BatchSize,
+			FlushInterval: time.Duration(t.FlushInterval),
+		}
+	}
+	if a := policy.AccessLog; a != nil {
+		lbConfig.AccessLog = loadbalancer.AccessLogConfig{
+			Enabled:          a.Enabled,
+			Format:           loadbalancer.AccessLogFormat(a.Format),
+			Output:           a.Output,
+			MaxSize:          a.MaxSize,
+			MaxAge:           time.Duration(a.MaxAge),
+			MaxBackups:       a.MaxBackups,
+			SampleRate:       a.SampleRate,
+			OnlySlowOrFailed: a.OnlySlowOrFailed,
+			SlowThreshold:    time.Duration(a.SlowThreshold),
+		}
+	}
+	if d := policy.Debug; d != nil {
+		lbConfig.Debug = loadbalancer.DebugConfig{Enabled: d.Enabled, Header: d.Header, Log: d.Log}
+	}
+}
+
+func headerRules(rules []config.HeaderRuleConfig) []loadbalancer.HeaderRule {
+	converted := make([]loadbalancer.HeaderRule, 0, len(rules))
+	for _, rule := range rules {
+		converted = append(converted, loadbalancer.HeaderRule{
+			Action: loadbalancer.HeaderAction(rule.Action),
+			Name:   rule.Name,
+			Value:  rule.Value,
+		})
+	}
+	return converted
+}
+
+// newServers returns the pool's static servers, leaving out DNS names.
+func newServers(poolCfg config.PoolConfig) []*loadbalancer.Server {
+	servers := make([]*loadbalancer.Server, 0, len(poolCfg.Servers))
+	for _, serverCfg := range poolCfg.Servers {
+		if serverCfg.Resolve != "" {
+			continue
+		}
+		servers = append(servers, &loadbalancer.Server{
 			ID:        serverCfg.ID,
 			Address:   serverCfg.Address,
+			Weight:    serverCfg.Weight,
 			IsHealthy: true,
 		})
 	}
+	return servers
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("/", lb)
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/health", handleHealth)
+func dnsTargets(poolCfg config.PoolConfig) []loadbalancer.DNSTarget {
+	var targets []loadbalancer.DNSTarget
+	for _, serverCfg := range poolCfg.Servers {
+		if serverCfg.Resolve != "" {
+			targets = append(targets, loadbalancer.DNSTarget{
+				ID:     serverCfg.ID,
+				Name:   serverCfg.Address,
+				SRV:    serverCfg.Resolve == "srv",
+				Weight: serverCfg.Weight,
+			})
+		}
+	}
+	return targets
+}
 
-	return &Server{
-		httpServer: &http.Server{
-			Addr:         ":" + cfg.Port,
-			Handler:      mux,
-			ReadTimeout:  cfg.ReadTimeout,
-			WriteTimeout: cfg.WriteTimeout,
-		},
-		lb:     lb,
-		config: cfg,
-		logger: logger,
+func newDiscovery(discoveryCfg config.DiscoveryConfig) loadbalancer.Discovery {
+	if discoveryCfg.Type == "http" {
+		return &loadbalancer.HTTPDiscovery{
+			URL:      discoveryCfg.URL,
+			Interval: time.Duration(discoveryCfg.Interval),
+			Wait:     time.Duration(discoveryCfg.Wait),
+		}
+	}
+	return &loadbalancer.FileDiscovery{
+		Path:     discoveryCfg.Path,
+		Interval: time.Duration(discoveryCfg.Interval),
 	}
 }
 
+// Handler returns the handler served on the main listener.
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
 func (s *Server) Start() error {
 	s.logger.Info("Starting server", slog.String("port", s.config.Port))
 
-	s.lb.StartProbing()
+	s.router.StartProbing()
+
+	for _, discovery := range s.discovery {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			discovery.Run(s.ctx)
+		}()
+	}
+	for _, poolCfg := range poolConfigs(s.config) {
+		lb := s.router.Pool(poolCfg.Name)
+		for i, discoveryCfg := range poolCfg.Discovery {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				source := fmt.Sprintf("discovery[%d]", i)
+				lb.RunDiscovery(s.ctx, source, newDiscovery(discoveryCfg), time.Duration(s.config.DrainTimeout))
+			}()
+		}
+	}
+
+	if s.adminServer != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.logger.Info("Starting admin server", slog.String("addr", s.adminServer.Addr))
+			if err := s.adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				s.logger.Error("Admin server error", slog.String("error", err.Error()))
+			}
+		}()
+	}
 
 	if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		return err
@@ -67,9 +437,19 @@ func (s *Server) Start() error {
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Info("Shutting down server")
 
+	s.stop()
+
 	if err := s.httpServer.Shutdown(ctx); err != nil {
 		return err
 	}
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if err := s.router.Shutdown(ctx); err != nil {
+		return err
+	}
 
 	done := make(chan struct{})
 	go func() {
@@ -90,3 +470,16 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status": "healthy"}`))
 }
+
+// poolsHandler serves the result of view for every pool as JSON, keyed by
+// pool name.
+func poolsHandler[T any](router *loadbalancer.Router, view func(*loadbalancer.LoadBalancer) T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pools := make(map[string]T)
+		for name, lb := range router.Pools() {
+			pools[name] = view(lb)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pools)
+	})
+}
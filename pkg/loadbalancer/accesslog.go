@@ -0,0 +1,217 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat string
+
+const (
+	AccessLogJSON     AccessLogFormat = "json"
+	AccessLogLogfmt   AccessLogFormat = "logfmt"
+	AccessLogCombined AccessLogFormat = "combined"
+)
+
+// AccessLogConfig configures per-request access logs. Output is "stdout" or
+// a file path; files are rotated when they grow past MaxSize or get older
+// than MaxAge, keeping MaxBackups old files. SampleRate keeps that fraction
+// of entries, and with OnlySlowOrFailed only requests slower than
+// SlowThreshold or with a 5xx status are logged.
+type AccessLogConfig struct {
+	Enabled          bool
+	Format           AccessLogFormat
+	Output           string
+	MaxSize          int64
+	MaxAge           time.Duration
+	MaxBackups       int
+	SampleRate       float64
+	OnlySlowOrFailed bool
+	SlowThreshold    time.Duration
+}
+
+type AccessLogEntry struct {
+	Time            time.Time     `json:"time"`
+	RequestID       string        `json:"request_id"`
+	RemoteAddr      string        `json:"remote_addr"`
+	Method          string        `json:"method"`
+	Path            string        `json:"path"`
+	Proto           string        `json:"proto"`
+	Status          int           `json:"status"`
+	Bytes           int64         `json:"bytes"`
+	ServerID        string        `json:"server_id"`
+	UpstreamLatency time.Duration `json:"upstream_latency"`
+	TotalLatency    time.Duration `json:"total_latency"`
+	Retries         int           `json:"retries"`
+	Algorithm       string        `json:"algorithm"`
+	Referer         string        `json:"referer"`
+	UserAgent       string        `json:"user_agent"`
+}
+
+type AccessLogger struct {
+	config AccessLogConfig
+	out    io.Writer
+	closer io.Closer
+	mutex  sync.Mutex
+}
+
+func NewAccessLogger(config AccessLogConfig) (*AccessLogger, error) {
+	if config.Format == "" {
+		config.Format = AccessLogJSON
+	}
+	if config.Output == "" {
+		config.Output = "stdout"
+	}
+	if config.SampleRate == 0 {
+		config.SampleRate = 1
+	}
+	if config.SlowThreshold == 0 {
+		config.SlowThreshold = time.Second
+	}
+
+	al := &AccessLogger{config: config}
+
+	switch config.Format {
+	case AccessLogJSON, AccessLogLogfmt, AccessLogCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", config.Format)
+	}
+
+	if config.Output == "stdout" {
+		al.out = os.Stdout
+		return al, nil
+	}
+
+	file, err := newRotatingFile(config.Output, config.MaxSize, config.MaxAge, config.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	al.out = file
+	al.closer = file
+	return al, nil
+}
+
+func (al *AccessLogger) Log(entry *AccessLogEntry) {
+	if al.config.OnlySlowOrFailed && entry.Status < 500 && entry.TotalLatency < al.config.SlowThreshold {
+		return
+	}
+	if al.config.SampleRate < 1 && rand.Float64() >= al.config.SampleRate {
+		return
+	}
+
+	var line []byte
+	switch al.config.Format {
+	case AccessLogLogfmt:
+		line = formatLogfmt(entry)
+	case AccessLogCombined:
+		line = formatCombined(entry)
+	default:
+		line = formatJSON(entry)
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.out.Write(line)
+}
+
+func (al *AccessLogger) Close() error {
+	if al == nil || al.closer == nil {
+		return nil
+	}
+	return al.closer.Close()
+}
+
+func formatJSON(e *AccessLogEntry) []byte {
+	line, _ := json.Marshal(struct {
+		*AccessLogEntry
+		UpstreamLatency float64 `json:"upstream_latency"`
+		TotalLatency    float64 `json:"total_latency"`
+	}{e, e.UpstreamLatency.Seconds(), e.TotalLatency.Seconds()})
+	return append(line, '\n')
+}
+
+func formatLogfmt(e *AccessLogEntry) []byte {
+	var b strings.Builder
+	field := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		if value == "" || strings.ContainsAny(value, " =\"") {
+			b.WriteString(strconv.Quote(value))
+		} else {
+			b.WriteString(value)
+		}
+	}
+
+	field("time", e.Time.Format(time.RFC3339Nano))
+	field("request_id", e.RequestID)
+	field("remote_addr", e.RemoteAddr)
+	field("method", e.Method)
+	field("path", e.Path)
+	field("proto", e.Proto)
+	field("status", strconv.Itoa(e.Status))
+	field("bytes", strconv.FormatInt(e.Bytes, 10))
+	field("server_id", e.ServerID)
+	field("upstream_latency", e.UpstreamLatency.String())
+	field("total_latency", e.TotalLatency.String())
+	field("retries", strconv.Itoa(e.Retries))
+	field("algorithm", e.Algorithm)
+	field("user_agent", e.UserAgent)
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// formatCombined writes the Apache Combined Log Format, followed by the
+// load balancer fields.
+func formatCombined(e *AccessLogEntry) []byte {
+	dash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+
+	return []byte(fmt.Sprintf("%s - - [%s] %q %d %d %q %q %s %s %d %s\n",
+		dash(e.RemoteAddr),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.Path+" "+e.Proto,
+		e.Status,
+		e.Bytes,
+		dash(e.Referer),
+		dash(e.UserAgent),
+		dash(e.ServerID),
+		strconv.FormatFloat(e.UpstreamLatency.Seconds(), 'f', 6, 64),
+		e.Retries,
+		e.Algorithm))
+}
+
+func (lb *LoadBalancer) newAccessLogEntry(r *http.Request) *AccessLogEntry {
+	return &AccessLogEntry{
+		Time:       time.Now(),
+		RequestID:  RequestIDFromContext(r.Context()),
+		RemoteAddr: clientIP(r),
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Proto:      r.Proto,
+		Algorithm:  string(lb.Algorithm()),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+func (lb *LoadBalancer) logAccess(entry *AccessLogEntry, recorder *statusRecorder) {
+	entry.Status = recorder.status
+	entry.Bytes = recorder.bytes
+	entry.TotalLatency = time.Since(entry.Time)
+	lb.accessLog.Log(entry)
+}
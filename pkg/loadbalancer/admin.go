@@ -0,0 +1,414 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrServerNotFound   = errors.New("server not found")
+	ErrServerExists     = errors.New("server already exists")
+	ErrInvalidServer    = errors.New("invalid server")
+	ErrUnknownAlgorithm = errors.New("unknown algorithm")
+
+	errBadRequest = errors.New("bad request")
+)
+
+// ServerState is the administrative state of a server. Only active servers
+// receive new requests; draining and disabled servers keep their in-flight
+// requests but are skipped by every algorithm.
+type ServerState int
+
+const (
+	ServerActive ServerState = iota
+	ServerDraining
+	ServerDisabled
+)
+
+func (s ServerState) String() string {
+	switch s {
+	case ServerDraining:
+		return "draining"
+	case ServerDisabled:
+		return "disabled"
+	default:
+		return "active"
+	}
+}
+
+func ParseServerState(value string) (ServerState, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "active", "enabled":
+		return ServerActive, nil
+	case "draining", "drained":
+		return ServerDraining, nil
+	case "disabled":
+		return ServerDisabled, nil
+	default:
+		return ServerActive, fmt.Errorf("unknown server state %q", value)
+	}
+}
+
+func (s ServerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *ServerState) UnmarshalText(text []byte) error {
+	state, err := ParseServerState(string(text))
+	if err != nil {
+		return err
+	}
+	*s = state
+	return nil
+}
+
+// available reports whether the server may be selected. It must be called
+// with lb.mutex held.
+func (s *Server) available() bool {
+	return s.IsHealthy && s.State == ServerActive
+}
+
+// weight must be called with lb.mutex held. Weights below one count as one.
+func (s *Server) weight() int {
+	return max(s.Weight, 1)
+}
+
+func (a Algorithm) valid() bool {
+	return a == AlgorithmPrequal || a == AlgorithmRoundRobin
+}
+
+// Algorithm returns the selection algorithm currently in use.
+func (lb *LoadBalancer) Algorithm() Algorithm {
+	return lb.algorithm.Load().(Algorithm)
+}
+
+// SetAlgorithm switches the selection algorithm. Requests already being
+// served keep the server they were given.
+func (lb *LoadBalancer) SetAlgorithm(algorithm Algorithm) error {
+	if !algorithm.valid() {
+		return fmt.Errorf("%w %q", ErrUnknownAlgorithm, algorithm)
+	}
+	lb.setAlgorithm(algorithm)
+	return nil
+}
+
+func (lb *LoadBalancer) setAlgorithm(algorithm Algorithm) {
+	if previous := lb.algorithm.Swap(algorithm); previous != algorithm {
+		lb.logger.Info("Algorithm changed",
+			slog.String("from", string(previous.(Algorithm))),
+			slog.String("to", string(algorithm)))
+	}
+}
+
+// ServerInfo is a point-in-time view of a server. Latency is the last probe
+// latency in milliseconds.
+type ServerInfo struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address"`
+	Healthy bool              `json:"healthy"`
+	State   ServerState       `json:"state"`
+	Weight  int               `json:"weight"`
+	RIF     int32             `json:"rif"`
+	Latency int64             `json:"latency_ms"`
+	Zone    string            `json:"zone,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// info must be called with lb.mutex held.
+func (s *Server) info() ServerInfo {
+	return ServerInfo{
+		ID:      s.ID,
+		Address: s.Address,
+		Healthy: s.IsHealthy,
+		State:   s.State,
+		Weight:  s.weight(),
+		RIF:     atomic.LoadInt32(&s.RIF),
+		Latency: s.Latency,
+		Zone:    s.Zone,
+		Labels:  maps.Clone(s.Labels),
+	}
+}
+
+func (lb *LoadBalancer) Servers() []ServerInfo {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	servers := make([]ServerInfo, 0, len(lb.servers))
+	for _, server := range lb.servers {
+		servers = append(servers, server.info())
+	}
+	return servers
+}
+
+func (lb *LoadBalancer) SetServerWeight(id string, weight int) error {
+	if err := validateWeight(weight); err != nil {
+		return err
+	}
+	return lb.updateServer(id, func(server *Server) {
+		server.Weight = weight
+	})
+}
+
+func validateWeight(weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("%w: weight must be at least 1", ErrInvalidServer)
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) SetServerState(id string, state ServerState) error {
+	return lb.updateServer(id, func(server *Server) {
+		server.State = state
+		server.adminState = true
+	})
+}
+
+func (lb *LoadBalancer) updateServer(id string, update func(*Server)) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	server := lb.serverByID(id)
+	if server == nil {
+		return fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+	update(server)
+	return nil
+}
+
+// AdminHandler serves the admin API:
+//
+//	GET    /servers               list servers
+//	POST   /servers               add a server: {"id", "address", "weight"}, weight defaults to 1
+//	DELETE /servers/{id}          remove a server
+//	PUT    /servers/{id}/weight   {"weight": 2}
+//	PUT    /servers/{id}/state    {"state": "active|draining|disabled"}
+//	POST   /servers/{id}/drain    drain, wait up to ?timeout=30s, then remove
+//	GET    /probes                latest probe result per server
+//	GET    /decisions             stream selection decisions as JSON lines
+//	GET    /algorithm             current algorithm
+//	PUT    /algorithm             {"algorithm": "prequal|roundrobin"}
+//
+// It has no authentication and should only be served on a private listener.
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, lb.Servers())
+	})
+
+	mux.HandleFunc("POST /servers", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ID      string `json:"id"`
+			Address string `json:"address"`
+			Weight  *int   `json:"weight"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		weight := 1
+		if body.Weight != nil {
+			weight = *body.Weight
+		}
+		if err := validateWeight(weight); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		server := &Server{ID: body.ID, Address: body.Address, Weight: weight, IsHealthy: true, source: adminSource}
+		if err := lb.AddServer(server); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		lb.logger.Info("Server added", slog.String("server", body.ID), slog.String("address", body.Address))
+
+		lb.mutex.RLock()
+		info := server.info()
+		lb.mutex.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+	})
+
+	mux.HandleFunc("DELETE /servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !lb.RemoveServer(id) {
+			writeAdminError(w, fmt.Errorf("%w: %s", ErrServerNotFound, id))
+			return
+		}
+		lb.logger.Info("Server removed", slog.String("server", id))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /servers/{id}/weight", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Weight int `json:"weight"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		lb.writeServer(w, r.PathValue("id"), lb.SetServerWeight(r.PathValue("id"), body.Weight))
+	})
+
+	mux.HandleFunc("PUT /servers/{id}/state", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			State ServerState `json:"state"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		id := r.PathValue("id")
+		err := lb.SetServerState(id, body.State)
+		if err == nil {
+			lb.logger.Info("Server state changed", slog.String("server", id), slog.String("state", body.State.String()))
+		}
+		lb.writeServer(w, id, err)
+	})
+
+	mux.HandleFunc("POST /servers/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		timeout := 30 * time.Second
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				writeAdminError(w, fmt.Errorf("%w: invalid timeout %q", errBadRequest, value))
+				return
+			}
+			timeout = parsed
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		event, err := lb.DrainServer(ctx, r.PathValue("id"))
+		if errors.Is(err, ErrServerNotFound) {
+			writeAdminError(w, err)
+			return
+		}
+
+		status := http.StatusOK
+		switch {
+		case errors.Is(err, ErrDrainCanceled):
+			status = http.StatusConflict
+		case err != nil:
+			status = http.StatusGatewayTimeout
+		}
+
+		body := map[string]any{
+			"server_id":        event.ServerID,
+			"drained":          err == nil,
+			"duration_seconds": event.Duration.Seconds(),
+			"remaining":        event.Remaining,
+		}
+		if err != nil {
+			body["error"] = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	})
+
+	mux.HandleFunc("GET /probes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, lb.ProbePool())
+	})
+
+	mux.HandleFunc("GET /decisions", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		decisions, unsubscribe := lb.SubscribeDecisions(64)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case decision := <-decisions:
+				if err := encoder.Encode(decision); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	mux.HandleFunc("GET /algorithm", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]Algorithm{"algorithm": lb.Algorithm()})
+	})
+
+	mux.HandleFunc("PUT /algorithm", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Algorithm Algorithm `json:"algorithm"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		if err := lb.SetAlgorithm(body.Algorithm); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, map[string]Algorithm{"algorithm": lb.Algorithm()})
+	})
+
+	return mux
+}
+
+func (lb *LoadBalancer) writeServer(w http.ResponseWriter, id string, err error) {
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	lb.mutex.RLock()
+	server := lb.serverByID(id)
+	var info ServerInfo
+	if server != nil {
+		info = server.info()
+	}
+	lb.mutex.RUnlock()
+
+	if server == nil {
+		writeAdminError(w, fmt.Errorf("%w: %s", ErrServerNotFound, id))
+		return
+	}
+	writeJSON(w, info)
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAdminError(w, fmt.Errorf("%w: %v", errBadRequest, err))
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrServerNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrServerExists):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidServer), errors.Is(err, ErrUnknownAlgorithm), errors.Is(err, errBadRequest):
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Priority is the admission priority of a request, as sent in
+// AdmissionConfig.PriorityHeader. Each priority maps onto a criticality
+// class: low priority traffic is sheddable and high priority traffic
+// critical.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Criticality returns the criticality class p maps onto.
+func (p Priority) Criticality() Criticality {
+	switch p {
+	case PriorityLow:
+		return CriticalitySheddable
+	case PriorityHigh:
+		return CriticalityCritical
+	default:
+		return CriticalityDefault
+	}
+}
+
+func ParsePriority(value string) Priority {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "low", "0":
+		return PriorityLow
+	case "high", "2":
+		return PriorityHigh
+	default:
+		return PriorityNormal
+	}
+}
+
+// AdmissionConfig limits how far a request may be pushed onto an overloaded
+// backend. A zero MaxRIF or MaxLatency disables that limit. Limits are scaled
+// per criticality class, so sheddable traffic is shed before default and
+// critical traffic. PriorityHeader, X-Priority by default, carries a
+// Priority that classifies requests sent without a criticality header.
+//
+// PriorityFactors is deprecated in favour of CriticalityFactors, and is only
+// used, keyed by the classes the priorities map onto, when
+// CriticalityFactors is nil.
+type AdmissionConfig struct {
+	Enabled            bool
+	MaxRIF             int32
+	MaxLatency         time.Duration
+	RetryAfter         time.Duration
+	PriorityHeader     string
+	PriorityFactors    map[Priority]float64
+	CriticalityFactors map[Criticality]float64
+}
+
+// DefaultCriticalityFactors returns the factors used when
+// AdmissionConfig.CriticalityFactors is nil.
+func DefaultCriticalityFactors() map[Criticality]float64 {
+	return map[Criticality]float64{
+		CriticalitySheddable: 0.5,
+		CriticalityDefault:   1.0,
+		CriticalityCritical:  1.5,
+	}
+}
+
+// criticalityFactors returns the factors to scale admission limits by.
+func (a AdmissionConfig) criticalityFactors() map[Criticality]float64 {
+	if a.CriticalityFactors != nil {
+		return a.CriticalityFactors
+	}
+	factors := DefaultCriticalityFactors()
+	for priority, factor := range a.PriorityFactors {
+		factors[priority.Criticality()] = factor
+	}
+	return factors
+}
+
+func (lb *LoadBalancer) admit(server *Server, criticality Criticality) bool {
+	admission := lb.config.Admission
+	if !admission.Enabled {
+		return true
+	}
+
+	factor, ok := admission.CriticalityFactors[criticality]
+	if !ok {
+		factor = 1.0
+	}
+
+	if admission.MaxRIF > 0 {
+		limit := float64(admission.MaxRIF) * factor
+		if float64(atomic.LoadInt32(&server.RIF)) >= limit {
+			return false
+		}
+	}
+
+	if admission.MaxLatency > 0 {
+		lb.mutex.RLock()
+		latency := time.Duration(server.Latency) * time.Millisecond
+		lb.mutex.RUnlock()
+
+		limit := time.Duration(float64(admission.MaxLatency) * factor)
+		if latency > limit {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (lb *LoadBalancer) shed(w http.ResponseWriter, r *http.Request, server *Server, criticality Criticality) {
+	algorithm := string(lb.Algorithm())
+	lb.metrics.shedRequests.WithLabelValues(algorithm, criticality.String()).Inc()
+	lb.stats.recordFailure()
+
+	lb.requestLogger(r).Warn("Request shed by admission control",
+		slog.String("server", server.ID),
+		slog.String("criticality", criticality.String()))
+
+	retryAfter := int(lb.config.Admission.RetryAfter.Round(time.Second) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Server overloaded", http.StatusServiceUnavailable)
+}
@@ -2,8 +2,11 @@ package loadbalancer
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -12,6 +15,11 @@ import (
 	"time"
 )
 
+var (
+	errNoServers     = errors.New("no available servers")
+	errServerRemoved = errors.New("server removed")
+)
+
 type LoadBalancer struct {
 	servers   []*Server
 	probePool map[string]*ProbeResult
@@ -19,10 +27,18 @@ type LoadBalancer struct {
 	stats     *Stats
 	logger    *slog.Logger
 	metrics   *Metrics
+	limiter   *ConcurrencyLimiter
+	tracer    *Tracer
+	accessLog *AccessLogger
+	algorithm atomic.Value
+	onDrain   []func(DrainEvent)
+	decisions decisionTap
 	mutex     sync.RWMutex
 	rrIndex   uint32
 }
 
+const defaultQRIF = 0.84
+
 func NewLoadBalancer(config *Config, logger *slog.Logger) *LoadBalancer {
 	if config == nil {
 		config = &Config{
@@ -31,54 +47,116 @@ func NewLoadBalancer(config *Config, logger *slog.Logger) *LoadBalancer {
 			HealthCheckPath:  "/health",
 			SelectionChoices: 2,
 			Algorithm:        AlgorithmPrequal,
-			QRIF:             0.84,
+			QRIF:             defaultQRIF,
 		}
 	}
 	if config.Algorithm == "" {
 		config.Algorithm = AlgorithmPrequal
 	}
 	if config.QRIF == 0 {
-		config.QRIF = 0.84
+		config.QRIF = defaultQRIF
+	}
+	if config.Admission.RetryAfter == 0 {
+		config.Admission.RetryAfter = time.Second
+	}
+	if config.Admission.PriorityHeader == "" {
+		config.Admission.PriorityHeader = "X-Priority"
+	}
+	config.Admission.CriticalityFactors = config.Admission.criticalityFactors()
+	if config.Criticality.Header == "" {
+		config.Criticality.Header = "X-Criticality"
+	}
+	if config.Sticky.CookieName == "" {
+		config.Sticky.CookieName = "lb_session"
+	}
+	if config.Debug.Header == "" {
+		config.Debug.Header = "X-LB-Debug"
+	}
+	if config.RequestIDHeader == "" {
+		config.RequestIDHeader = "X-Request-ID"
+	}
+	if config.Headers.InstanceID == "" {
+		config.Headers.InstanceID = defaultInstanceID()
+	}
+	if config.Timeouts.DeadlineHeader == "" {
+		config.Timeouts.DeadlineHeader = "X-Request-Deadline"
 	}
 
-	return &LoadBalancer{
+	lb := &LoadBalancer{
 		servers:   make([]*Server, 0),
 		probePool: make(map[string]*ProbeResult),
 		config:    config,
-		stats:     &Stats{},
+		stats:     newStats(),
 		logger:    logger,
-		metrics:   NewMetrics(),
+		metrics:   NewMetrics(config.Metrics),
+	}
+
+	lb.algorithm.Store(config.Algorithm)
+	lb.compileCriticalityRoutes()
+
+	if config.ConcurrencyLimit.Algorithm != LimitAlgorithmNone {
+		lb.limiter = NewConcurrencyLimiter(config.ConcurrencyLimit)
+	}
+	if config.Tracing.Enabled {
+		lb.tracer = NewTracer(config.Tracing, logger)
 	}
+	if config.AccessLog.Enabled {
+		accessLog, err := NewAccessLogger(config.AccessLog)
+		if err != nil {
+			logger.Error("Failed to open access log, access logging disabled",
+				slog.String("error", err.Error()))
+		}
+		lb.accessLog = accessLog
+	}
+
+	return lb
 }
 
 func (lb *LoadBalancer) StartProbing() {
 	go func() {
-		ticker := time.NewTicker(lb.config.ProbeInterval)
+		lb.mutex.RLock()
+		interval := lb.config.ProbeInterval
+		lb.mutex.RUnlock()
+
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			lb.probeAllServers()
+			if next := lb.probeAllServers(); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
 		}
 	}()
 }
 
-func (lb *LoadBalancer) probeAllServers() {
+// probeAllServers probes every server in the background and returns the
+// probe interval, which SetProbing may have changed.
+func (lb *LoadBalancer) probeAllServers() time.Duration {
 	lb.mutex.RLock()
 	servers := make([]*Server, len(lb.servers))
 	copy(servers, lb.servers)
+	interval := lb.config.ProbeInterval
+	timeout := lb.config.ProbeTimeout
+	path := lb.config.HealthCheckPath
 	lb.mutex.RUnlock()
 
 	for _, server := range servers {
 		go func(srv *Server) {
-			result := lb.probeServer(srv)
+			result := lb.probeServer(srv, timeout, path)
 
 			lb.mutex.Lock()
+			if lb.serverByID(srv.ID) != srv {
+				lb.mutex.Unlock()
+				return
+			}
 			lb.probePool[srv.ID] = result
+			lb.metrics.probePoolSize.Set(float64(len(lb.probePool)))
 			srv.IsHealthy = result.IsHealthy
 			srv.Latency = result.Latency
 			lb.mutex.Unlock()
 
-			algorithm := string(lb.config.Algorithm)
+			algorithm := string(lb.Algorithm())
 			if result.IsHealthy {
 				lb.metrics.serverHealth.WithLabelValues(srv.ID, algorithm).Set(1)
 			} else {
@@ -86,23 +164,23 @@ func (lb *LoadBalancer) probeAllServers() {
 			}
 		}(server)
 	}
+	return interval
 }
 
-func (lb *LoadBalancer) probeServer(server *Server) *ProbeResult {
-	ctx, cancel := context.WithTimeout(context.Background(), lb.config.ProbeTimeout)
+func (lb *LoadBalancer) probeServer(server *Server, timeout time.Duration, healthCheckPath string) *ProbeResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	lb.metrics.probesSent.WithLabelValues(server.ID).Inc()
+
 	start := time.Now()
 	req, err := http.NewRequestWithContext(ctx, "GET",
-		"http://"+server.Address+lb.config.HealthCheckPath, nil)
+		"http://"+server.Address+healthCheckPath, nil)
 	if err != nil {
 		lb.logger.Error("Failed to create probe request",
 			slog.String("server", server.ID),
 			slog.String("error", err.Error()))
-		return &ProbeResult{
-			Timestamp: time.Now(),
-			IsHealthy: false,
-		}
+		return lb.probeFailed(server, "request", err)
 	}
 
 	resp, err := http.DefaultClient.Do(req)
@@ -110,36 +188,148 @@ func (lb *LoadBalancer) probeServer(server *Server) *ProbeResult {
 		lb.logger.Error("Probe request failed",
 			slog.String("server", server.ID),
 			slog.String("error", err.Error()))
-		return &ProbeResult{
-			Timestamp: time.Now(),
-			IsHealthy: false,
-		}
+		return lb.probeFailed(server, errorCause(err), err)
 	}
 	defer resp.Body.Close()
 
 	duration := time.Since(start)
+	lb.metrics.probeDuration.WithLabelValues(server.ID).Observe(duration.Seconds())
 
-	return &ProbeResult{
+	result := &ProbeResult{
 		Timestamp: time.Now(),
 		RIF:       atomic.LoadInt32(&server.RIF),
 		Latency:   duration.Milliseconds(),
 		IsHealthy: resp.StatusCode == http.StatusOK,
 	}
+	if !result.IsHealthy {
+		result.Error = resp.Status
+		lb.metrics.probeFailures.WithLabelValues(server.ID, "status").Inc()
+	}
+	return result
+}
+
+func (lb *LoadBalancer) probeFailed(server *Server, reason string, err error) *ProbeResult {
+	lb.metrics.probeFailures.WithLabelValues(server.ID, reason).Inc()
+	return &ProbeResult{
+		Timestamp: time.Now(),
+		IsHealthy: false,
+		Error:     err.Error(),
+	}
 }
 
-func (lb *LoadBalancer) AddServer(server *Server) {
+// AddServer adds server unless its ID is already taken or its address is not
+// a host:port pair.
+func (lb *LoadBalancer) AddServer(server *Server) error {
+	if err := validateServer(server); err != nil {
+		return err
+	}
+
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
+
+	if lb.serverByID(server.ID) != nil {
+		return fmt.Errorf("%w: %s", ErrServerExists, server.ID)
+	}
+	server.removed = false
 	lb.servers = append(lb.servers, server)
+	return nil
+}
+
+func validateServer(server *Server) error {
+	if server.ID == "" {
+		return fmt.Errorf("%w: missing id", ErrInvalidServer)
+	}
+	if _, _, err := net.SplitHostPort(server.Address); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidServer, err)
+	}
+	return nil
+}
+
+// RemoveServer removes the server with the given ID along with its probe
+// results and metric series. It reports whether the server was found.
+func (lb *LoadBalancer) RemoveServer(id string) bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.removeServer(lb.serverByID(id))
+}
+
+// removeServer must be called with lb.mutex held.
+func (lb *LoadBalancer) removeServer(target *Server) bool {
+	for i, server := range lb.servers {
+		if server == target {
+			lb.servers = append(lb.servers[:i:i], lb.servers[i+1:]...)
+			server.removed = true
+			delete(lb.probePool, server.ID)
+			lb.metrics.probePoolSize.Set(float64(len(lb.probePool)))
+			lb.metrics.removeServer(server.ID)
+			lb.stats.removeServer(server.ID)
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown flushes any spans that have not been exported yet and closes the
+// access log.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+	return errors.Join(lb.tracer.Shutdown(ctx), lb.accessLog.Close())
+}
+
+// serverByID must be called with lb.mutex held.
+func (lb *LoadBalancer) serverByID(id string) *Server {
+	for _, server := range lb.servers {
+		if server.ID == id {
+			return server
+		}
+	}
+	return nil
 }
 
 func (lb *LoadBalancer) SelectServer() *Server {
-	if lb.config.Algorithm == AlgorithmRoundRobin {
-		return lb.selectServerRR()
+	server, _ := lb.selectServer(nil)
+	return server
+}
+
+// pickServer picks the server for r: the server r's sticky cookie is pinned
+// to, unless that is failed, and otherwise the algorithm's choice. It
+// returns whether the server was hot and the selection outcome.
+func (lb *LoadBalancer) pickServer(r *http.Request, decision *Decision, failed *Server) (*Server, bool, string) {
+	if lb.config.Sticky.Enabled {
+		if server := lb.stickyServer(r); server != nil && server != failed {
+			decision.setWinner(server, false)
+			return server, false, "sticky"
+		}
 	}
-	return lb.selectServerPrequal()
+	server, hot := lb.selectServer(decision)
+	return server, hot, selectionOutcome(server, hot)
 }
 
+// selectServer picks a server and reports whether it was hot. When decision
+// is non-nil it is filled in with the inputs to the choice.
+func (lb *LoadBalancer) selectServer(decision *Decision) (*Server, bool) {
+	if lb.Algorithm() == AlgorithmRoundRobin {
+		server := lb.selectServerRR()
+		decision.setWinner(server, false)
+		return server, false
+	}
+	server, hot := lb.selectServerPrequal(decision)
+	decision.setWinner(server, hot)
+	return server, hot
+}
+
+func selectionOutcome(server *Server, hot bool) string {
+	switch {
+	case server == nil:
+		return "no_server"
+	case hot:
+		return "hot"
+	default:
+		return "cold"
+	}
+}
+
+// selectServerRR walks the available servers in order, giving each as many
+// consecutive turns as its weight.
 func (lb *LoadBalancer) selectServerRR() *Server {
 	lb.mutex.RLock()
 	defer lb.mutex.RUnlock()
@@ -148,69 +338,98 @@ func (lb *LoadBalancer) selectServerRR() *Server {
 		return nil
 	}
 
-	healthyServers := make([]*Server, 0, len(lb.servers))
+	availableServers := make([]*Server, 0, len(lb.servers))
+	totalWeight := 0
 	for _, server := range lb.servers {
-		if server.IsHealthy {
-			healthyServers = append(healthyServers, server)
+		if server.available() {
+			availableServers = append(availableServers, server)
+			totalWeight += server.weight()
 		}
 	}
 
-	if len(healthyServers) == 0 {
+	if len(availableServers) == 0 {
 		return nil
 	}
 
 	index := atomic.AddUint32(&lb.rrIndex, 1)
-	return healthyServers[int(index-1)%len(healthyServers)]
+	return pickWeighted(availableServers, int(index-1)%totalWeight)
+}
+
+// pickWeighted returns the server whose cumulative weight range contains n.
+func pickWeighted(servers []*Server, n int) *Server {
+	for _, server := range servers {
+		n -= server.weight()
+		if n < 0 {
+			return server
+		}
+	}
+	return servers[len(servers)-1]
 }
 
-func (lb *LoadBalancer) selectServerPrequal() *Server {
+// selectServerPrequal samples candidates in proportion to their weight.
+// Unhealthy servers can be sampled and are then skipped, as in the paper;
+// draining and disabled servers are never sampled.
+func (lb *LoadBalancer) selectServerPrequal(decision *Decision) (*Server, bool) {
 	lb.mutex.RLock()
 	defer lb.mutex.RUnlock()
 
-	if len(lb.servers) == 0 {
-		return nil
+	servers := make([]*Server, 0, len(lb.servers))
+	totalWeight := 0
+	for _, server := range lb.servers {
+		if server.State == ServerActive {
+			servers = append(servers, server)
+			totalWeight += server.weight()
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, false
 	}
 
 	candidates := make([]*Server, 0, lb.config.SelectionChoices)
 	for i := 0; i < lb.config.SelectionChoices; i++ {
-		randomIndex := rand.Intn(len(lb.servers))
-		candidates = append(candidates, lb.servers[randomIndex])
+		candidates = append(candidates, pickWeighted(servers, rand.Intn(totalWeight)))
 	}
 
-	return lb.selectBestCandidate(candidates)
+	return lb.selectBestCandidate(candidates, decision)
 }
 
-func (lb *LoadBalancer) selectBestCandidate(candidates []*Server) *Server {
+func (lb *LoadBalancer) selectBestCandidate(candidates []*Server, decision *Decision) (*Server, bool) {
 	healthyCandidates := make([]*Server, 0, len(candidates))
 	for _, server := range candidates {
 		if server.IsHealthy {
 			healthyCandidates = append(healthyCandidates, server)
+		} else {
+			decision.addUnhealthy(server)
 		}
 	}
 
 	if len(healthyCandidates) == 0 {
-		return nil
+		return nil, false
 	}
 
 	rifThreshold := lb.calculateRIFThreshold(healthyCandidates)
+	decision.setThreshold(rifThreshold)
 
 	var coldServers []*Server
 	var hotServers []*Server
 
 	for _, server := range healthyCandidates {
+		lb.useProbe(server)
 		rif := atomic.LoadInt32(&server.RIF)
 		if rif > rifThreshold {
 			hotServers = append(hotServers, server)
 		} else {
 			coldServers = append(coldServers, server)
 		}
+		decision.addCandidate(server, rif, rif > rifThreshold)
 	}
 
 	if len(coldServers) > 0 {
-		return lb.selectLowestLatency(coldServers)
+		return lb.selectLowestLatency(coldServers), false
 	}
 
-	return lb.selectLowestRIF(hotServers)
+	return lb.selectLowestRIF(hotServers), true
 }
 
 func (lb *LoadBalancer) calculateRIFThreshold(servers []*Server) int32 {
@@ -223,20 +442,44 @@ func (lb *LoadBalancer) calculateRIFThreshold(servers []*Server) int32 {
 		rifValues[i] = atomic.LoadInt32(&server.RIF)
 	}
 
-	for i := 0; i < len(rifValues)-1; i++ {
-		for j := i + 1; j < len(rifValues); j++ {
-			if rifValues[i] > rifValues[j] {
-				rifValues[i], rifValues[j] = rifValues[j], rifValues[i]
-			}
-		}
-	}
-
 	index := int(float64(len(rifValues)-1) * lb.config.QRIF)
 	if index >= len(rifValues) {
 		index = len(rifValues) - 1
 	}
 
-	return rifValues[index]
+	return nthSmallest(rifValues, index)
+}
+
+// nthSmallest returns the value that would be at index k if values were
+// sorted, reordering values in expected linear time.
+func nthSmallest(values []int32, k int) int32 {
+	lo, hi := 0, len(values)-1
+	for lo < hi {
+		pivot := values[lo+rand.Intn(hi-lo+1)]
+		i, j := lo, hi
+		for i <= j {
+			for values[i] < pivot {
+				i++
+			}
+			for values[j] > pivot {
+				j--
+			}
+			if i <= j {
+				values[i], values[j] = values[j], values[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case k <= j:
+			hi = j
+		case k >= i:
+			lo = i
+		default:
+			return values[k]
+		}
+	}
+	return values[k]
 }
 
 func (lb *LoadBalancer) selectLowestLatency(servers []*Server) *Server {
@@ -279,44 +522,225 @@ func (lb *LoadBalancer) selectLowestRIF(servers []*Server) *Server {
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	atomic.AddUint64(&lb.stats.TotalRequests, 1)
 
-	server := lb.SelectServer()
+	r = lb.withRequestID(w, r)
+	logger := lb.requestLogger(r)
+
+	var entry *AccessLogEntry
+	if lb.accessLog != nil {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		entry = lb.newAccessLogEntry(r)
+		defer lb.logAccess(entry, recorder)
+		w = recorder
+	}
+
+	ctx, span := lb.tracer.StartFromRequest(r, "loadbalancer.request")
+	defer span.End()
+	r = r.WithContext(ctx)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("lb.request_id", RequestIDFromContext(ctx))
+	span.SetAttribute("lb.algorithm", string(lb.Algorithm()))
+
+	r, cancel := lb.withDeadline(r)
+	defer cancel()
+
+	if r.Context().Err() != nil {
+		lb.stats.recordFailure()
+		http.Error(w, "Deadline exceeded", http.StatusGatewayTimeout)
+		return
+	}
+
+	criticality := lb.classify(r)
+
+	if lb.limiter != nil && !lb.limiter.AcquireCriticality(r.Context(), criticality, lb.limiterShare(criticality)) {
+		lb.rejectOverLimit(w)
+		return
+	}
+
+	// The limiter slot is returned and the request recorded in a defer, so
+	// both still happen when the proxy aborts the handler with
+	// http.ErrAbortHandler halfway through a response body.
+	var server *Server
+	var start time.Time
+	var err error
+	retries := 0
+	completed := false
+	defer func() {
+		if start.IsZero() {
+			lb.cancelLimiter()
+			return
+		}
+
+		failed := err != nil || !completed
+		duration := time.Since(start)
+		lb.releaseLimiter(duration, failed)
+
+		if entry != nil {
+			entry.ServerID = server.ID
+			entry.UpstreamLatency = duration
+			entry.Retries = retries
+		}
+		span.SetAttribute("lb.server_id", server.ID)
+		lb.stats.recordRequest(duration, failed)
+		lb.metrics.requestDuration.WithLabelValues(string(lb.Algorithm())).Observe(duration.Seconds())
+	}()
+
+	_, selectSpan := lb.tracer.Start(r.Context(), "loadbalancer.select", SpanKindInternal)
+	decision := lb.newDecision(r)
+	server, hot, outcome := lb.pickServer(r, decision, nil)
+	if lb.config.Sticky.Enabled {
+		selectSpan.SetAttribute("lb.sticky", outcome == "sticky")
+	}
+	lb.metrics.selections.WithLabelValues(string(lb.Algorithm()), outcome).Inc()
+	lb.reportDecision(w, r, decision)
+	if server != nil {
+		selectSpan.SetAttribute("lb.server_id", server.ID)
+		selectSpan.SetAttribute("lb.server_rif", atomic.LoadInt32(&server.RIF))
+		selectSpan.SetAttribute("lb.server_hot", hot)
+	}
+	selectSpan.End()
+
 	if server == nil {
-		lb.logger.Error("No available servers")
-		atomic.AddUint64(&lb.stats.FailedRequests, 1)
+		span.RecordError(errNoServers)
+		logger.Error("No available servers")
+		lb.stats.recordFailure()
 		http.Error(w, "No available servers", http.StatusServiceUnavailable)
 		return
 	}
 
-	start := time.Now()
-	lb.forwardRequest(server, w, r)
-	duration := time.Since(start)
+	// Sheddable traffic never adds load to a hot server, that capacity is
+	// kept for default and critical requests.
+	if criticality == CriticalitySheddable && (hot || lb.isHot(server)) {
+		span.SetAttribute("lb.shed", true)
+		lb.shed(w, r, server, criticality)
+		return
+	}
+
+	if !lb.admit(server, criticality) {
+		span.SetAttribute("lb.shed", true)
+		lb.shed(w, r, server, criticality)
+		return
+	}
 
-	algorithm := string(lb.config.Algorithm)
-	lb.metrics.requestDuration.WithLabelValues(algorithm).Observe(duration.Seconds())
-	atomic.AddUint64(&lb.stats.SuccessfulRequests, 1)
+	start = time.Now()
+	err = lb.forwardRequest(server, criticality, 0, w, r)
+	// The request never left, so the server can be swapped without a retry.
+	for errors.Is(err, errServerRemoved) {
+		if next, _, _ := lb.pickServer(r, nil, server); next != nil && lb.admit(next, criticality) {
+			server = next
+			err = lb.forwardRequest(server, criticality, 0, w, r)
+		} else {
+			err = errNoServers
+		}
+	}
+	for ; err != nil && retries < lb.config.Retry.MaxRetries && isRetryable(r, criticality); retries++ {
+		next, _, _ := lb.pickServer(r, nil, server)
+		if next == nil || !lb.admit(next, criticality) || !lb.hasBudget(r, next) {
+			break
+		}
+
+		logger.Warn("Retrying request",
+			slog.String("failed_server", server.ID),
+			slog.String("server", next.ID))
+		server = next
+		err = lb.forwardRequest(server, criticality, retries+1, w, r)
+	}
+	completed = true
+
+	if err != nil {
+		span.RecordError(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "Upstream timeout", http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		}
+	}
 }
 
-func (lb *LoadBalancer) forwardRequest(server *Server, w http.ResponseWriter, r *http.Request) {
-	algorithm := string(lb.config.Algorithm)
+// forwardRequest proxies r to server. It returns errServerRemoved without
+// sending anything if server left the pool after it was selected.
+func (lb *LoadBalancer) forwardRequest(server *Server, criticality Criticality, attempt int, w http.ResponseWriter, r *http.Request) error {
+	// Counting the request before checking that the server is still in the
+	// pool means a drain, which checks RIF under the write lock, either waits
+	// for it or has already removed the server.
 	atomic.AddInt32(&server.RIF, 1)
+	lb.mutex.RLock()
+	removed := server.removed
+	lb.mutex.RUnlock()
+	if removed {
+		atomic.AddInt32(&server.RIF, -1)
+		return errServerRemoved
+	}
+
+	ctx, span := lb.tracer.Start(r.Context(), "loadbalancer.upstream", SpanKindClient)
+	defer span.End()
+	r = r.WithContext(ctx)
+	span.SetAttribute("lb.server_id", server.ID)
+	span.SetAttribute("lb.attempt", attempt)
+	span.SetAttribute("server.address", server.Address)
+
+	algorithm := string(lb.Algorithm())
+	lb.trackClassRIF(server, criticality, 1)
 	lb.metrics.activeRequests.WithLabelValues(algorithm).Inc()
 
 	defer func() {
 		atomic.AddInt32(&server.RIF, -1)
+		lb.trackClassRIF(server, criticality, -1)
 		lb.metrics.activeRequests.WithLabelValues(algorithm).Dec()
 
 		currentRIF := atomic.LoadInt32(&server.RIF)
 		lb.metrics.serverRIF.WithLabelValues(server.ID, algorithm).Set(float64(currentRIF))
 	}()
 
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	var sent *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		sent = &countingReader{ReadCloser: r.Body}
+		r.Body = sent
+	}
+
 	targetURL, _ := url.Parse("http://" + server.Address)
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	headers := lb.newHeaderTemplate(r, server)
+	trusted := lb.trustedPeer(r)
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(targetURL)
+			pr.Out.Host = pr.In.Host
+			setForwarded(pr, trusted)
+			lb.setDeadlineHeaders(pr)
+			if span != nil {
+				pr.Out.Header.Set(traceparentHeader, span.Context().Traceparent())
+			}
+			headers.apply(pr.Out.Header, lb.config.Headers.Request)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// The client already has the load balancer's request ID.
+			resp.Header.Del(lb.config.RequestIDHeader)
+			span.SetAttribute("http.response.status_code", resp.StatusCode)
+			headers.apply(resp.Header, lb.config.Headers.Response)
+			// Only the attempt that got a response pins the client.
+			if lb.config.Sticky.Enabled {
+				lb.setStickyCookie(resp.Header, r, server)
+			}
+			return nil
+		},
+	}
 
+	var proxyErr error
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		lb.logger.Error("Proxy error", slog.String("error", err.Error()))
-		atomic.AddUint64(&lb.stats.FailedRequests, 1)
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		proxyErr = err
+		span.RecordError(err)
+		lb.requestLogger(r).Error("Proxy error",
+			slog.String("server", server.ID),
+			slog.String("error", err.Error()))
 	}
 
-	proxy.ServeHTTP(w, r)
+	proxy.ServeHTTP(recorder, r)
+
+	duration := time.Since(start)
+	lb.metrics.observeBackend(server.ID, algorithm, r.Method, recorder, sent, proxyErr, duration)
+	lb.stats.recordAttempt(server.ID, duration, proxyErr != nil)
+	return proxyErr
 }
@@ -0,0 +1,134 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+type Criticality int
+
+const (
+	CriticalityDefault Criticality = iota
+	CriticalitySheddable
+	CriticalityCritical
+
+	criticalityClasses = 3
+)
+
+func (c Criticality) String() string {
+	switch c {
+	case CriticalitySheddable:
+		return "sheddable"
+	case CriticalityCritical:
+		return "critical"
+	default:
+		return "default"
+	}
+}
+
+// ParseCriticality maps a header or config value onto a criticality class.
+// Unknown values fall back to CriticalityDefault.
+func ParseCriticality(value string) Criticality {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "sheddable", "batch", "prefetch", "low", "0":
+		return CriticalitySheddable
+	case "critical", "interactive", "high", "2":
+		return CriticalityCritical
+	default:
+		return CriticalityDefault
+	}
+}
+
+type CriticalityRoute struct {
+	PathPrefix  string
+	PathRegex   string
+	Criticality Criticality
+
+	pathRegex *regexp.Regexp
+}
+
+// CriticalityConfig classifies requests. A header on the request, Header or
+// else AdmissionConfig.PriorityHeader, takes precedence over the first matching route, which takes
+// precedence over Default. ReservedShare is the fraction of the concurrency
+// limit that sheddable traffic may never use, so there is always room for
+// critical requests.
+type CriticalityConfig struct {
+	Header        string
+	Routes        []CriticalityRoute
+	Default       Criticality
+	ReservedShare float64
+}
+
+func (lb *LoadBalancer) compileCriticalityRoutes() {
+	for i := range lb.config.Criticality.Routes {
+		route := &lb.config.Criticality.Routes[i]
+		if route.PathRegex == "" {
+			continue
+		}
+		re, err := regexp.Compile(route.PathRegex)
+		if err != nil {
+			lb.logger.Error("Invalid criticality route regex, ignoring",
+				slog.String("regex", route.PathRegex),
+				slog.String("error", err.Error()))
+			continue
+		}
+		route.pathRegex = re
+	}
+}
+
+func (lb *LoadBalancer) classify(r *http.Request) Criticality {
+	config := lb.config.Criticality
+
+	if value := r.Header.Get(config.Header); value != "" {
+		return ParseCriticality(value)
+	}
+	if value := r.Header.Get(lb.config.Admission.PriorityHeader); value != "" {
+		return ParsePriority(value).Criticality()
+	}
+
+	for _, route := range config.Routes {
+		if route.PathPrefix != "" && strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			return route.Criticality
+		}
+		if route.pathRegex != nil && route.pathRegex.MatchString(r.URL.Path) {
+			return route.Criticality
+		}
+	}
+
+	return config.Default
+}
+
+func (s *Server) ClassRIF(c Criticality) int32 {
+	return atomic.LoadInt32(&s.classRIF[c])
+}
+
+func (lb *LoadBalancer) trackClassRIF(server *Server, c Criticality, delta int32) {
+	rif := atomic.AddInt32(&server.classRIF[c], delta)
+	lb.metrics.serverClassRIF.WithLabelValues(server.ID, string(lb.Algorithm()), c.String()).Set(float64(rif))
+}
+
+func (lb *LoadBalancer) limiterShare(c Criticality) float64 {
+	if c == CriticalitySheddable {
+		return 1 - lb.config.Criticality.ReservedShare
+	}
+	return 1
+}
+
+// isHot reports whether server is above the QRIF quantile of RIF across all
+// available servers, not just the sampled candidates.
+func (lb *LoadBalancer) isHot(server *Server) bool {
+	lb.mutex.RLock()
+	available := make([]*Server, 0, len(lb.servers))
+	for _, s := range lb.servers {
+		if s.available() {
+			available = append(available, s)
+		}
+	}
+	threshold := lb.calculateRIFThreshold(available)
+	lb.mutex.RUnlock()
+
+	return atomic.LoadInt32(&server.RIF) > threshold
+}
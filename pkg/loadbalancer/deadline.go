@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const grpcTimeoutHeader = "Grpc-Timeout"
+
+type TimeoutRoute struct {
+	PathPrefix string
+	Timeout    time.Duration
+}
+
+// TimeoutConfig bounds how long a request may spend upstream. The effective
+// deadline is the earliest of the matching route timeout (or Default) and any
+// deadline the client sent in DeadlineHeader or grpc-timeout. A zero timeout
+// means no limit.
+type TimeoutConfig struct {
+	Default        time.Duration
+	Routes         []TimeoutRoute
+	DeadlineHeader string
+}
+
+// RetryConfig controls retries of idempotent, bodyless requests that failed
+// before the backend sent a response. Sheddable requests are never retried.
+// A retry is skipped when the remaining deadline budget is shorter than the
+// next backend's observed latency.
+type RetryConfig struct {
+	MaxRetries int
+}
+
+func (lb *LoadBalancer) routeTimeout(r *http.Request) time.Duration {
+	config := lb.config.Timeouts
+
+	timeout := config.Default
+	longest := -1
+	for _, route := range config.Routes {
+		if strings.HasPrefix(r.URL.Path, route.PathPrefix) && len(route.PathPrefix) > longest {
+			longest = len(route.PathPrefix)
+			timeout = route.Timeout
+		}
+	}
+	return timeout
+}
+
+// requestDeadline returns the deadline for r, and false when it has none.
+func (lb *LoadBalancer) requestDeadline(r *http.Request) (time.Time, bool) {
+	var deadline time.Time
+
+	if timeout := lb.routeTimeout(r); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	if value := r.Header.Get(lb.config.Timeouts.DeadlineHeader); value != "" {
+		if incoming, err := ParseDeadline(value); err == nil {
+			deadline = earliest(deadline, incoming)
+		}
+	}
+
+	if value := r.Header.Get(grpcTimeoutHeader); value != "" {
+		if timeout, err := ParseGRPCTimeout(value); err == nil {
+			deadline = earliest(deadline, time.Now().Add(timeout))
+		}
+	}
+
+	return deadline, !deadline.IsZero()
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// withDeadline attaches the request's deadline to its context.
+func (lb *LoadBalancer) withDeadline(r *http.Request) (*http.Request, context.CancelFunc) {
+	deadline, ok := lb.requestDeadline(r)
+	if !ok {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return r.WithContext(ctx), cancel
+}
+
+// setDeadlineHeaders rewrites the deadline headers of the outbound request
+// so the backend sees the remaining budget. The inbound request is left as
+// the client sent it.
+func (lb *LoadBalancer) setDeadlineHeaders(pr *httputil.ProxyRequest) {
+	deadline, ok := pr.In.Context().Deadline()
+	if !ok {
+		return
+	}
+
+	pr.Out.Header.Set(lb.config.Timeouts.DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+	if pr.Out.Header.Get(grpcTimeoutHeader) != "" {
+		pr.Out.Header.Set(grpcTimeoutHeader, FormatGRPCTimeout(time.Until(deadline)))
+	}
+}
+
+// hasBudget reports whether a request against server can still finish
+// before r's deadline, judged by the server's observed latency.
+func (lb *LoadBalancer) hasBudget(r *http.Request, server *Server) bool {
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		return true
+	}
+
+	lb.mutex.RLock()
+	expected := time.Duration(server.Latency) * time.Millisecond
+	lb.mutex.RUnlock()
+
+	return time.Until(deadline) > expected
+}
+
+func isRetryable(r *http.Request, criticality Criticality) bool {
+	if criticality == CriticalitySheddable {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.ContentLength == 0
+	default:
+		return false
+	}
+}
+
+// ParseDeadline parses an absolute deadline given either as an RFC 3339
+// timestamp or as Unix milliseconds.
+func ParseDeadline(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// ParseGRPCTimeout parses the grpc-timeout header format, e.g. "250m".
+func ParseGRPCTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("invalid grpc-timeout unit in %q", value)
+	}
+
+	return time.Duration(amount) * unit, nil
+}
+
+func FormatGRPCTimeout(d time.Duration) string {
+	if d < time.Millisecond {
+		return "1m"
+	}
+	return strconv.FormatInt(d.Milliseconds(), 10) + "m"
+}
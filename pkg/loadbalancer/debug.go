@@ -0,0 +1,188 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DebugConfig enables selection debugging. When a request carries Header
+// with a true value, the selection decision is returned in the
+// X-LB-Decision response header and, with Log set, logged at debug level.
+type DebugConfig struct {
+	Enabled bool
+	Header  string
+	Log     bool
+}
+
+type Candidate struct {
+	ID      string        `json:"id"`
+	RIF     int32         `json:"rif"`
+	Latency time.Duration `json:"latency"`
+	Healthy bool          `json:"healthy"`
+	Hot     bool          `json:"hot"`
+}
+
+// Decision records how a server was chosen for a request.
+type Decision struct {
+	Time       time.Time   `json:"time"`
+	Algorithm  string      `json:"algorithm"`
+	Candidates []Candidate `json:"candidates"`
+	Threshold  int32       `json:"rif_threshold"`
+	Winner     string      `json:"winner"`
+	Hot        bool        `json:"hot"`
+	RequestID  string      `json:"request_id,omitempty"`
+
+	requested bool
+}
+
+func (d *Decision) setThreshold(threshold int32) {
+	if d != nil {
+		d.Threshold = threshold
+	}
+}
+
+func (d *Decision) addCandidate(server *Server, rif int32, hot bool) {
+	if d == nil {
+		return
+	}
+	d.Candidates = append(d.Candidates, Candidate{
+		ID:      server.ID,
+		RIF:     rif,
+		Latency: time.Duration(server.Latency) * time.Millisecond,
+		Healthy: true,
+		Hot:     hot,
+	})
+}
+
+func (d *Decision) addUnhealthy(server *Server) {
+	if d == nil {
+		return
+	}
+	d.Candidates = append(d.Candidates, Candidate{ID: server.ID})
+}
+
+func (d *Decision) setWinner(server *Server, hot bool) {
+	if d == nil || server == nil {
+		return
+	}
+	d.Winner = server.ID
+	d.Hot = hot
+}
+
+// String formats the decision for the X-LB-Decision header, e.g.
+// "algorithm=prequal threshold=2 candidates=a:rif=1,lat=12ms,cold;b:rif=4,lat=9ms,hot winner=a".
+func (d *Decision) String() string {
+	candidates := make([]string, 0, len(d.Candidates))
+	for _, c := range d.Candidates {
+		state := "cold"
+		switch {
+		case !c.Healthy:
+			state = "unhealthy"
+		case c.Hot:
+			state = "hot"
+		}
+		candidates = append(candidates, fmt.Sprintf("%s:rif=%d,lat=%s,%s", c.ID, c.RIF, c.Latency, state))
+	}
+
+	winner := d.Winner
+	if winner == "" {
+		winner = "none"
+	}
+
+	return fmt.Sprintf("algorithm=%s threshold=%d candidates=%s winner=%s",
+		d.Algorithm, d.Threshold, strings.Join(candidates, ";"), winner)
+}
+
+// newDecision returns a Decision to fill in if r asked for debugging or
+// someone is tailing decisions, or nil.
+func (lb *LoadBalancer) newDecision(r *http.Request) *Decision {
+	requested := false
+	if lb.config.Debug.Enabled {
+		requested, _ = strconv.ParseBool(r.Header.Get(lb.config.Debug.Header))
+	}
+	if !requested && lb.decisions.count.Load() == 0 {
+		return nil
+	}
+	return &Decision{
+		Time:      time.Now(),
+		Algorithm: string(lb.Algorithm()),
+		RequestID: RequestIDFromContext(r.Context()),
+		requested: requested,
+	}
+}
+
+func (lb *LoadBalancer) reportDecision(w http.ResponseWriter, r *http.Request, decision *Decision) {
+	if decision == nil {
+		return
+	}
+
+	lb.decisions.publish(*decision)
+	if !decision.requested {
+		return
+	}
+
+	w.Header().Set("X-LB-Decision", decision.String())
+	if lb.config.Debug.Log {
+		lb.requestLogger(r).Debug("Selection decision",
+			slog.String("algorithm", decision.Algorithm),
+			slog.Any("candidates", decision.Candidates),
+			slog.Int("rif_threshold", int(decision.Threshold)),
+			slog.String("winner", decision.Winner),
+			slog.Bool("hot", decision.Hot))
+	}
+}
+
+// decisionTap fans selection decisions out to subscribers. Subscribers that
+// fall behind miss decisions rather than slowing down requests.
+type decisionTap struct {
+	mutex       sync.Mutex
+	subscribers map[chan Decision]struct{}
+	count       atomic.Int32
+}
+
+func (t *decisionTap) publish(decision Decision) {
+	if t.count.Load() == 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- decision:
+		default:
+		}
+	}
+}
+
+// SubscribeDecisions returns a channel that receives every selection decision
+// from now on, and a function that ends the subscription and closes it.
+func (lb *LoadBalancer) SubscribeDecisions(buffer int) (<-chan Decision, func()) {
+	t := &lb.decisions
+	subscriber := make(chan Decision, buffer)
+
+	t.mutex.Lock()
+	if t.subscribers == nil {
+		t.subscribers = make(map[chan Decision]struct{})
+	}
+	t.subscribers[subscriber] = struct{}{}
+	t.count.Add(1)
+	t.mutex.Unlock()
+
+	var once sync.Once
+	return subscriber, func() {
+		once.Do(func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			delete(t.subscribers, subscriber)
+			t.count.Add(-1)
+			close(subscriber)
+		})
+	}
+}
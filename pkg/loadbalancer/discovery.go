@@ -0,0 +1,299 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	discoveryMinBackoff = time.Second
+	discoveryMaxBackoff = 30 * time.Second
+)
+
+// Endpoint is a server reported by service discovery. ID defaults to Address.
+type Endpoint struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address"`
+	Weight  int               `json:"weight,omitempty"`
+	Zone    string            `json:"zone,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// Discovery is a source of endpoints. Next returns the full set of
+// endpoints, at once on the first call and after that once the set may have
+// changed, blocking until then or until ctx is done.
+type Discovery interface {
+	Next(ctx context.Context) ([]Endpoint, error)
+}
+
+// RunDiscovery makes the endpoints from discovery the servers of source, as
+// SetServers does, until ctx is done. Failed updates are logged and retried
+// with backoff, and the last good servers are kept in the meantime.
+func (lb *LoadBalancer) RunDiscovery(ctx context.Context, source string, discovery Discovery, drainTimeout time.Duration) {
+	backoff := discoveryMinBackoff
+	for {
+		endpoints, err := discovery.Next(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			var diff ServerDiff
+			diff, err = lb.SetServers(source, endpointServers(endpoints), drainTimeout)
+			if err == nil && !diff.Empty() {
+				lb.logger.Info("Discovered servers changed",
+					slog.String("source", source),
+					slog.Any("added", diff.Added),
+					slog.Any("removed", diff.Removed),
+					slog.Any("replaced", diff.Replaced),
+					slog.Any("updated", diff.Updated))
+			}
+		}
+		if err == nil {
+			lb.metrics.discoveryUpdates.WithLabelValues(source, "success").Inc()
+			backoff = discoveryMinBackoff
+			continue
+		}
+
+		lb.metrics.discoveryUpdates.WithLabelValues(source, "failure").Inc()
+		lb.logger.Warn("Discovery failed, keeping the last good servers",
+			slog.String("source", source),
+			slog.Duration("retry_in", backoff),
+			slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, discoveryMaxBackoff)
+	}
+}
+
+func endpointServers(endpoints []Endpoint) []*Server {
+	servers := make([]*Server, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.ID == "" {
+			endpoint.ID = endpoint.Address
+		}
+		servers = append(servers, &Server{
+			ID:        endpoint.ID,
+			Address:   endpoint.Address,
+			Weight:    endpoint.Weight,
+			Zone:      endpoint.Zone,
+			Labels:    endpoint.Labels,
+			IsHealthy: true,
+		})
+	}
+	return servers
+}
+
+// decodeEndpoints decodes a JSON, or with yamlFormat set a YAML, list of
+// endpoints. Unknown fields are rejected.
+func decodeEndpoints(data []byte, yamlFormat bool) ([]Endpoint, error) {
+	if yamlFormat {
+		var doc []any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	var endpoints []Endpoint
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// FileDiscovery reads endpoints from a JSON file, or a YAML file if Path ends
+// in .yaml or .yml, holding a list of endpoints in the spirit of Prometheus'
+// file_sd:
+//
+//	[{"id": "api-1", "address": "10.0.0.1:8080", "zone": "us-east-1a", "labels": {"version": "v2"}}]
+//
+// The file is read again whenever its size or modification time changes,
+// which is checked every Interval, 5s by default. A file that can't be read
+// or parsed is reported once and then waited on until it changes again.
+type FileDiscovery struct {
+	Path     string
+	Interval time.Duration
+
+	started bool
+	last    os.FileInfo
+}
+
+func (d *FileDiscovery) Next(ctx context.Context) ([]Endpoint, error) {
+	interval := d.Interval
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+
+	if d.started {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(d.Path)
+			if err != nil {
+				continue
+			}
+			if d.last == nil || !info.ModTime().Equal(d.last.ModTime()) || info.Size() != d.last.Size() {
+				break
+			}
+		}
+	}
+
+	d.started = true
+	d.last, _ = os.Stat(d.Path)
+	data, err := os.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(d.Path))
+	endpoints, err := decodeEndpoints(data, ext == ".yaml" || ext == ".yml")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.Path, err)
+	}
+	return endpoints, nil
+}
+
+// HTTPDiscovery polls a URL that returns a JSON list of endpoints, the same
+// format FileDiscovery reads, as a stand-in for catalogs such as Consul or
+// Eureka. The response's ETag is sent back in If-None-Match, so an unchanged
+// list can be answered with 304 Not Modified.
+//
+// Without Wait the URL is polled every Interval, 10s by default. With Wait
+// set, each request carries a wait parameter, e.g. ?wait=30s, and the server
+// is expected to hold it until the list changes or Wait has passed, so
+// changes are picked up as soon as they happen. A response that comes back
+// sooner than Wait is still followed by a pause of Interval, so a server that
+// ignores the parameter isn't polled in a tight loop.
+type HTTPDiscovery struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client   *http.Client
+	Interval time.Duration
+	Wait     time.Duration
+
+	polled bool
+	// early is set when the last poll came back sooner than Wait.
+	early bool
+	etag  string
+	last  []Endpoint
+}
+
+func (d *HTTPDiscovery) Next(ctx context.Context) ([]Endpoint, error) {
+	interval := d.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	for {
+		if d.polled && (d.Wait == 0 || d.early) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+
+		start := time.Now()
+		endpoints, changed, err := d.poll(ctx)
+		if err != nil {
+			// Retry at once on the next call, RunDiscovery has backed off.
+			d.polled = false
+			return nil, err
+		}
+		d.polled = true
+		d.early = time.Since(start) < d.Wait
+		if changed {
+			return endpoints, nil
+		}
+	}
+}
+
+// poll requests the endpoints once and reports whether they changed since the
+// last poll.
+func (d *HTTPDiscovery) poll(ctx context.Context) ([]Endpoint, bool, error) {
+	target, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, false, err
+	}
+	if d.Wait > 0 {
+		query := target.Query()
+		query.Set("wait", d.Wait.String())
+		target.RawQuery = query.Encode()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.Wait+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.etag != "" && d.last != nil {
+		req.Header.Set("If-None-Match", d.etag)
+	}
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("%s: unexpected status %s", d.URL, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	endpoints, err := decodeEndpoints(data, false)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", d.URL, err)
+	}
+	if endpoints == nil {
+		endpoints = []Endpoint{}
+	}
+
+	d.etag = resp.Header.Get("ETag")
+	if reflect.DeepEqual(endpoints, d.last) {
+		return nil, false, nil
+	}
+	d.last = endpoints
+	return endpoints, true, nil
+}
@@ -0,0 +1,308 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dnsSource = "dns"
+
+// Resolver looks up the records behind DNS discovery targets. ttl is how long
+// the answer may be cached, or zero if the resolver can't tell.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, ttl time.Duration, err error)
+	LookupSRV(ctx context.Context, name string) (records []*net.SRV, ttl time.Duration, err error)
+}
+
+// SystemResolver resolves names with a net.Resolver, or net.DefaultResolver if
+// nil. The standard library doesn't expose TTLs, so names resolved with it are
+// looked up again every DNSConfig.Refresh.
+type SystemResolver struct {
+	Resolver *net.Resolver
+}
+
+func (r SystemResolver) resolver() *net.Resolver {
+	if r.Resolver != nil {
+		return r.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (r SystemResolver) LookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	addrs, err := r.resolver().LookupHost(ctx, host)
+	return addrs, 0, err
+}
+
+func (r SystemResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	_, records, err := r.resolver().LookupSRV(ctx, "", "", name)
+	return records, 0, err
+}
+
+// DNSTarget is a DNS name that stands for a group of servers. Name is a
+// host:port whose host is resolved to A/AAAA records, or with SRV set, an SRV
+// record name such as _http._tcp.api.internal. Each resolved address becomes
+// a server with the ID "<ID>/<address>". Servers get Weight, or for SRV
+// records the record's weight when it is set.
+type DNSTarget struct {
+	ID     string
+	Name   string
+	SRV    bool
+	Weight int
+}
+
+type DNSConfig struct {
+	// Resolver defaults to SystemResolver.
+	Resolver Resolver
+	// Refresh is the longest time between lookups of a name, 30s by default.
+	// Shorter TTLs reported by the Resolver are respected down to MinRefresh,
+	// 1s by default. SystemResolver reports none.
+	Refresh    time.Duration
+	MinRefresh time.Duration
+	// Timeout bounds each lookup, 5s by default.
+	Timeout time.Duration
+	// DrainTimeout is how long servers whose address disappeared are drained
+	// before removal. Zero removes them at once.
+	DrainTimeout time.Duration
+}
+
+// DNSDiscovery keeps one server per resolved address in a LoadBalancer. When a
+// lookup fails, or returns no records, the target keeps its last good
+// servers and is retried with backoff.
+type DNSDiscovery struct {
+	lb      *LoadBalancer
+	config  DNSConfig
+	mutex   sync.Mutex
+	targets []DNSTarget
+	state   map[string]*dnsState
+	wake    chan struct{}
+}
+
+type dnsState struct {
+	servers  []*Server
+	next     time.Time
+	failures int
+}
+
+func NewDNSDiscovery(lb *LoadBalancer, targets []DNSTarget, config DNSConfig) *DNSDiscovery {
+	if config.Resolver == nil {
+		config.Resolver = SystemResolver{}
+	}
+	if config.Refresh == 0 {
+		config.Refresh = 30 * time.Second
+	}
+	if config.MinRefresh == 0 {
+		config.MinRefresh = time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &DNSDiscovery{
+		lb:      lb,
+		config:  config,
+		targets: targets,
+		state:   make(map[string]*dnsState),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// SetTargets replaces the targets. Servers of targets no longer listed are
+// removed, and new targets are resolved right away if Run is running.
+func (d *DNSDiscovery) SetTargets(targets []DNSTarget) {
+	d.mutex.Lock()
+	d.targets = targets
+	d.mutex.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run resolves each target when it is due until ctx is done.
+func (d *DNSDiscovery) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-d.wake:
+			timer.Stop()
+		}
+
+		next := d.refresh(ctx)
+		timer.Reset(time.Until(next))
+	}
+}
+
+// Resolve looks up every target now and updates the load balancer. It returns
+// the lookup errors; targets that failed keep their last good servers.
+func (d *DNSDiscovery) Resolve(ctx context.Context) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var errs []error
+	for _, target := range d.targets {
+		if err := d.resolve(ctx, target); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	d.reconcile()
+	return errors.Join(errs...)
+}
+
+// refresh resolves the targets that are due and returns when the next one is
+// due.
+func (d *DNSDiscovery) refresh(ctx context.Context) time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	next := time.Now().Add(d.config.Refresh)
+	for _, target := range d.targets {
+		state := d.state[target.ID]
+		if state == nil || !time.Now().Before(state.next) {
+			d.resolve(ctx, target)
+			state = d.state[target.ID]
+		}
+		if state.next.Before(next) {
+			next = state.next
+		}
+	}
+	d.reconcile()
+	return next
+}
+
+// resolve must be called with d.mutex held.
+func (d *DNSDiscovery) resolve(ctx context.Context, target DNSTarget) error {
+	state := d.state[target.ID]
+	if state == nil {
+		state = &dnsState{}
+		d.state[target.ID] = state
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+
+	servers, ttl, err := d.lookup(ctx, target)
+	if err == nil && len(servers) == 0 {
+		err = errors.New("no records")
+	}
+	if err != nil {
+		state.failures++
+		backoff := d.config.MinRefresh << min(state.failures-1, 16)
+		state.next = time.Now().Add(min(backoff, d.config.Refresh))
+
+		d.lb.metrics.dnsLookups.WithLabelValues(target.Name, "failure").Inc()
+		d.lb.logger.Warn("DNS lookup failed, keeping the last good servers",
+			slog.String("name", target.Name),
+			slog.Int("servers", len(state.servers)),
+			slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", target.Name, err)
+	}
+
+	if ttl <= 0 || ttl > d.config.Refresh {
+		ttl = d.config.Refresh
+	}
+	state.servers = servers
+	state.next = time.Now().Add(max(ttl, d.config.MinRefresh))
+	state.failures = 0
+	d.lb.metrics.dnsLookups.WithLabelValues(target.Name, "success").Inc()
+	return nil
+}
+
+func (d *DNSDiscovery) lookup(ctx context.Context, target DNSTarget) ([]*Server, time.Duration, error) {
+	newServer := func(address string, weight int) *Server {
+		return &Server{ID: target.ID + "/" + address, Address: address, Weight: weight, IsHealthy: true}
+	}
+
+	if target.SRV {
+		records, ttl, err := d.config.Resolver.LookupSRV(ctx, target.Name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Only the records with the lowest priority are used.
+		sort.Slice(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+		var servers []*Server
+		for _, record := range records {
+			if record.Priority != records[0].Priority {
+				break
+			}
+			weight := target.Weight
+			if record.Weight > 0 {
+				weight = int(record.Weight)
+			}
+			host := strings.TrimSuffix(record.Target, ".")
+			servers = append(servers, newServer(net.JoinHostPort(host, strconv.Itoa(int(record.Port))), weight))
+		}
+		return servers, ttl, nil
+	}
+
+	host, port, err := net.SplitHostPort(target.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+	addrs, ttl, err := d.config.Resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(addrs)
+	addrs = slices.Compact(addrs)
+	servers := make([]*Server, 0, len(addrs))
+	for _, addr := range addrs {
+		servers = append(servers, newServer(net.JoinHostPort(addr, port), target.Weight))
+	}
+	return servers, ttl, nil
+}
+
+// reconcile sets the load balancer's DNS servers to the last good servers of
+// every target. Each call hands SetServers fresh servers, since one it added
+// earlier may since have been drained or removed. It must be called with
+// d.mutex held.
+func (d *DNSDiscovery) reconcile() {
+	current := make(map[string]bool, len(d.targets))
+	var servers []*Server
+	for _, target := range d.targets {
+		current[target.ID] = true
+		if state := d.state[target.ID]; state != nil {
+			for _, server := range state.servers {
+				servers = append(servers, &Server{
+					ID:        server.ID,
+					Address:   server.Address,
+					Weight:    server.Weight,
+					IsHealthy: true,
+				})
+			}
+		}
+	}
+	for id := range d.state {
+		if !current[id] {
+			delete(d.state, id)
+		}
+	}
+
+	diff, err := d.lb.SetServers(dnsSource, servers, d.config.DrainTimeout)
+	if err != nil {
+		d.lb.logger.Error("Failed to apply DNS servers", slog.String("error", err.Error()))
+		return
+	}
+	if !diff.Empty() {
+		d.lb.logger.Info("DNS servers changed",
+			slog.Any("added", diff.Added),
+			slog.Any("removed", diff.Removed),
+			slog.Any("replaced", diff.Replaced),
+			slog.Any("updated", diff.Updated))
+	}
+}
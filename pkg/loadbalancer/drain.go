@@ -0,0 +1,122 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const drainPollInterval = 10 * time.Millisecond
+
+var ErrDrainCanceled = errors.New("drain canceled")
+
+// DrainEvent reports the end of a drain. Err is nil when the server's
+// in-flight requests finished and it was removed. Otherwise the server was
+// not removed: Err is ErrDrainCanceled if it was set back to active or
+// removed during the drain, or the context error if the drain timed out with
+// Remaining requests still in flight.
+type DrainEvent struct {
+	ServerID  string
+	Duration  time.Duration
+	Remaining int32
+	Err       error
+}
+
+// OnDrain registers handler to be called when a drain ends. Handlers run
+// synchronously on the draining goroutine.
+func (lb *LoadBalancer) OnDrain(handler func(DrainEvent)) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.onDrain = append(lb.onDrain, handler)
+}
+
+// DrainServer stops sending new requests to the server, waits until its RIF
+// reaches zero and then removes it. If ctx ends first the server is left
+// draining, so the drain can be retried or the server removed outright.
+func (lb *LoadBalancer) DrainServer(ctx context.Context, id string) (DrainEvent, error) {
+	lb.mutex.Lock()
+	server := lb.serverByID(id)
+	if server == nil {
+		lb.mutex.Unlock()
+		return DrainEvent{ServerID: id}, fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+	server.State = ServerDraining
+	server.adminState = true
+	lb.mutex.Unlock()
+
+	return lb.drain(ctx, server)
+}
+
+// drain waits for a server already marked draining.
+func (lb *LoadBalancer) drain(ctx context.Context, server *Server) (DrainEvent, error) {
+	id := server.ID
+	lb.logger.Info("Draining server",
+		slog.String("server", id),
+		slog.Int("rif", int(atomic.LoadInt32(&server.RIF))))
+
+	start := time.Now()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		lb.mutex.Lock()
+		if lb.serverByID(id) != server || server.State != ServerDraining {
+			lb.mutex.Unlock()
+			return lb.finishDrain(server, start, ErrDrainCanceled)
+		}
+		if atomic.LoadInt32(&server.RIF) == 0 {
+			lb.removeServer(server)
+			lb.mutex.Unlock()
+			return lb.finishDrain(server, start, nil)
+		}
+		lb.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return lb.finishDrain(server, start, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *LoadBalancer) finishDrain(server *Server, start time.Time, err error) (DrainEvent, error) {
+	event := DrainEvent{
+		ServerID:  server.ID,
+		Duration:  time.Since(start),
+		Remaining: atomic.LoadInt32(&server.RIF),
+		Err:       err,
+	}
+
+	result := "completed"
+	switch {
+	case errors.Is(err, ErrDrainCanceled):
+		result = "canceled"
+	case err != nil:
+		result = "timeout"
+	}
+	lb.metrics.serverDrains.WithLabelValues(result).Inc()
+
+	if err != nil {
+		lb.logger.Warn("Server drain did not complete",
+			slog.String("server", server.ID),
+			slog.String("result", result),
+			slog.Int("rif", int(event.Remaining)),
+			slog.Duration("duration", event.Duration))
+	} else {
+		lb.logger.Info("Server drained and removed",
+			slog.String("server", server.ID),
+			slog.Duration("duration", event.Duration))
+	}
+
+	lb.mutex.RLock()
+	handlers := lb.onDrain
+	lb.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+
+	return event, err
+}
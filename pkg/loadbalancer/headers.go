@@ -0,0 +1,157 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+type HeaderAction string
+
+const (
+	HeaderAdd    HeaderAction = "add"
+	HeaderSet    HeaderAction = "set"
+	HeaderRemove HeaderAction = "remove"
+)
+
+// HeaderRule changes a request or response header. Value may contain the
+// templates {client_ip}, {server_id}, {request_id}, {instance_id}, {host},
+// {method} and {path}.
+type HeaderRule struct {
+	Action HeaderAction
+	Name   string
+	Value  string
+}
+
+// HeaderConfig holds the header rules applied to every proxied request and
+// response. InstanceID identifies this load balancer and defaults to the
+// hostname. Forwarding headers sent by a peer in TrustedProxies are extended
+// with this hop; from any other peer they are replaced.
+type HeaderConfig struct {
+	Request        []HeaderRule
+	Response       []HeaderRule
+	InstanceID     string
+	TrustedProxies []netip.Prefix
+}
+
+// ParseTrustedProxy parses a CIDR prefix such as 10.0.0.0/8, or a single IP
+// address, for HeaderConfig.TrustedProxies.
+func ParseTrustedProxy(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(value)
+}
+
+// trustedPeer reports whether r came directly from one of the trusted proxies.
+func (lb *LoadBalancer) trustedPeer(r *http.Request) bool {
+	if len(lb.config.Headers.TrustedProxies) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range lb.config.Headers.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type headerTemplate struct {
+	replacer *strings.Replacer
+}
+
+func (lb *LoadBalancer) newHeaderTemplate(r *http.Request, server *Server) headerTemplate {
+	return headerTemplate{
+		replacer: strings.NewReplacer(
+			"{client_ip}", clientIP(r),
+			"{server_id}", server.ID,
+			"{request_id}", RequestIDFromContext(r.Context()),
+			"{instance_id}", lb.config.Headers.InstanceID,
+			"{host}", r.Host,
+			"{method}", r.Method,
+			"{path}", r.URL.Path,
+		),
+	}
+}
+
+func (t headerTemplate) apply(header http.Header, rules []HeaderRule) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderAdd:
+			header.Add(rule.Name, t.replacer.Replace(rule.Value))
+		case HeaderSet:
+			header.Set(rule.Name, t.replacer.Replace(rule.Value))
+		case HeaderRemove:
+			header.Del(rule.Name)
+		}
+	}
+}
+
+// setForwarded sets X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and
+// the RFC 7239 Forwarded header for this hop. With trusted set, the inbound
+// values of both kinds are kept and this hop is appended to their chains;
+// otherwise they are dropped, so a client can't claim another address.
+func setForwarded(pr *httputil.ProxyRequest, trusted bool) {
+	if trusted {
+		pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+	}
+	pr.SetXForwarded()
+	if trusted {
+		for _, name := range []string{"X-Forwarded-Host", "X-Forwarded-Proto"} {
+			if value := pr.In.Header.Get(name); value != "" {
+				pr.Out.Header.Set(name, value)
+			}
+		}
+	}
+
+	proto := "http"
+	if pr.In.TLS != nil {
+		proto = "https"
+	}
+
+	forwardedFor := clientIP(pr.In)
+	if strings.Contains(forwardedFor, ":") {
+		forwardedFor = `"[` + forwardedFor + `]"`
+	}
+
+	element := "for=" + forwardedFor + ";host=" + quoteForwarded(pr.In.Host) + ";proto=" + proto
+	if prior := pr.In.Header.Values("Forwarded"); trusted && len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	pr.Out.Header.Set("Forwarded", element)
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\" ;,") {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "loadbalancer"
+	}
+	return hostname
+}
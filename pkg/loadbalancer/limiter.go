@@ -0,0 +1,306 @@
+package loadbalancer
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+type LimitAlgorithm string
+
+const (
+	LimitAlgorithmNone     LimitAlgorithm = ""
+	LimitAlgorithmGradient LimitAlgorithm = "gradient"
+	LimitAlgorithmAIMD     LimitAlgorithm = "aimd"
+)
+
+// ConcurrencyLimitConfig configures the adaptive limit on total in-flight
+// requests, modelled on Netflix's concurrency-limits. The gradient algorithm
+// compares the no-load RTT with the current RTT; AIMD grows the limit by one
+// while it is in use and backs off on drops or timeouts.
+type ConcurrencyLimitConfig struct {
+	Algorithm    LimitAlgorithm
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	Smoothing    float64
+	Backoff      float64
+	Timeout      time.Duration
+	// ResetInterval is how many samples pass before the learned no-load RTT
+	// is forgotten, so the limiter can adapt when the fleet gets slower.
+	ResetInterval int
+	// QueueTimeout is how long a request may wait for a slot once the limit
+	// is reached. Zero rejects at once. Waiting requests are admitted
+	// critical first, and sheddable requests never wait.
+	QueueTimeout time.Duration
+}
+
+type limitAlgorithm interface {
+	update(rtt time.Duration, inflight int, dropped bool) float64
+	rtts() (noLoad, current time.Duration)
+}
+
+type ConcurrencyLimiter struct {
+	mutex     sync.Mutex
+	config    ConcurrencyLimitConfig
+	algorithm limitAlgorithm
+	limit     float64
+	inflight  int
+	waiting   [criticalityClasses][]*limiterWaiter
+}
+
+type limiterWaiter struct {
+	share float64
+	ready chan struct{}
+}
+
+func NewConcurrencyLimiter(config ConcurrencyLimitConfig) *ConcurrencyLimiter {
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = 20
+	}
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = 1000
+	}
+	if config.Smoothing <= 0 || config.Smoothing > 1 {
+		config.Smoothing = 0.2
+	}
+	if config.Backoff <= 0 || config.Backoff >= 1 {
+		config.Backoff = 0.9
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.ResetInterval <= 0 {
+		config.ResetInterval = 1000
+	}
+
+	limiter := &ConcurrencyLimiter{
+		config: config,
+		limit:  float64(config.InitialLimit),
+	}
+
+	switch config.Algorithm {
+	case LimitAlgorithmAIMD:
+		limiter.algorithm = &aimdLimit{limiter: limiter}
+	default:
+		limiter.algorithm = &gradientLimit{limiter: limiter}
+	}
+
+	return limiter
+}
+
+func (l *ConcurrencyLimiter) Acquire() bool {
+	return l.AcquireShare(1)
+}
+
+// AcquireShare admits a request only while in-flight requests are below the
+// given share of the current limit.
+func (l *ConcurrencyLimiter) AcquireShare(share float64) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if float64(l.inflight) >= math.Floor(l.limit*share) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// AcquireCriticality is AcquireShare for a request of class c. When the
+// limit is reached, critical and default requests wait up to QueueTimeout for
+// a slot, or until ctx is done, and are handed freed slots critical first.
+func (l *ConcurrencyLimiter) AcquireCriticality(ctx context.Context, c Criticality, share float64) bool {
+	l.mutex.Lock()
+	if float64(l.inflight) < math.Floor(l.limit*share) {
+		l.inflight++
+		l.mutex.Unlock()
+		return true
+	}
+	if l.config.QueueTimeout <= 0 || c == CriticalitySheddable {
+		l.mutex.Unlock()
+		return false
+	}
+	waiter := &limiterWaiter{share: share, ready: make(chan struct{})}
+	l.waiting[c] = append(l.waiting[c], waiter)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(l.config.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-waiter.ready:
+		// Handed a slot while giving up, so give it back.
+		l.inflight--
+		l.wake()
+	default:
+		l.waiting[c] = slices.DeleteFunc(l.waiting[c], func(w *limiterWaiter) bool { return w == waiter })
+	}
+	return false
+}
+
+// wake hands free slots to waiting requests, critical first. It must be
+// called with l.mutex held.
+func (l *ConcurrencyLimiter) wake() {
+	for _, c := range []Criticality{CriticalityCritical, CriticalityDefault} {
+		for len(l.waiting[c]) > 0 {
+			waiter := l.waiting[c][0]
+			if float64(l.inflight) >= math.Floor(l.limit*waiter.share) {
+				return
+			}
+			l.waiting[c] = l.waiting[c][1:]
+			l.inflight++
+			close(waiter.ready)
+		}
+	}
+}
+
+func (l *ConcurrencyLimiter) Release(rtt time.Duration, dropped bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	inflight := l.inflight
+	l.inflight--
+
+	if rtt > l.config.Timeout {
+		dropped = true
+	}
+
+	limit := l.algorithm.update(rtt, inflight, dropped)
+	l.limit = math.Max(float64(l.config.MinLimit), math.Min(float64(l.config.MaxLimit), limit))
+	l.wake()
+}
+
+// Cancel releases a slot without feeding a sample to the algorithm, for
+// requests that never reached a backend.
+func (l *ConcurrencyLimiter) Cancel() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inflight--
+	l.wake()
+}
+
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int(l.limit)
+}
+
+func (l *ConcurrencyLimiter) Inflight() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inflight
+}
+
+func (l *ConcurrencyLimiter) RTTs() (noLoad, current time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.algorithm.rtts()
+}
+
+type gradientLimit struct {
+	limiter    *ConcurrencyLimiter
+	noLoadRTT  time.Duration
+	currentRTT time.Duration
+	samples    int
+}
+
+func (g *gradientLimit) update(rtt time.Duration, inflight int, dropped bool) float64 {
+	limit := g.limiter.limit
+	if dropped {
+		return limit * g.limiter.config.Backoff
+	}
+
+	g.samples++
+	if g.samples >= g.limiter.config.ResetInterval {
+		g.samples = 0
+		g.noLoadRTT = 0
+	}
+	if g.noLoadRTT == 0 || rtt < g.noLoadRTT {
+		g.noLoadRTT = rtt
+	}
+	g.currentRTT = rtt
+
+	// Don't grow the limit when it isn't being used.
+	if float64(inflight) < limit/2 {
+		return limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1.0, float64(g.noLoadRTT)/float64(rtt)))
+	queueSize := math.Sqrt(limit)
+	newLimit := limit*gradient + queueSize
+
+	smoothing := g.limiter.config.Smoothing
+	return limit*(1-smoothing) + newLimit*smoothing
+}
+
+func (g *gradientLimit) rtts() (time.Duration, time.Duration) {
+	return g.noLoadRTT, g.currentRTT
+}
+
+type aimdLimit struct {
+	limiter    *ConcurrencyLimiter
+	noLoadRTT  time.Duration
+	currentRTT time.Duration
+}
+
+func (a *aimdLimit) update(rtt time.Duration, inflight int, dropped bool) float64 {
+	limit := a.limiter.limit
+	if dropped {
+		return limit * a.limiter.config.Backoff
+	}
+
+	if a.noLoadRTT == 0 || rtt < a.noLoadRTT {
+		a.noLoadRTT = rtt
+	}
+	a.currentRTT = rtt
+
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+func (a *aimdLimit) rtts() (time.Duration, time.Duration) {
+	return a.noLoadRTT, a.currentRTT
+}
+
+func (lb *LoadBalancer) releaseLimiter(rtt time.Duration, dropped bool) {
+	if lb.limiter == nil {
+		return
+	}
+
+	lb.limiter.Release(rtt, dropped)
+
+	algorithm := string(lb.Algorithm())
+	noLoad, current := lb.limiter.RTTs()
+	lb.metrics.concurrencyLimit.WithLabelValues(algorithm).Set(float64(lb.limiter.Limit()))
+	lb.metrics.concurrencyRTT.WithLabelValues(algorithm, "no_load").Set(noLoad.Seconds())
+	lb.metrics.concurrencyRTT.WithLabelValues(algorithm, "current").Set(current.Seconds())
+}
+
+func (lb *LoadBalancer) cancelLimiter() {
+	if lb.limiter != nil {
+		lb.limiter.Cancel()
+	}
+}
+
+func (lb *LoadBalancer) rejectOverLimit(w http.ResponseWriter) {
+	algorithm := string(lb.Algorithm())
+	lb.metrics.concurrencyRejections.WithLabelValues(algorithm).Inc()
+	lb.stats.recordFailure()
+	http.Error(w, "Concurrency limit exceeded", http.StatusServiceUnavailable)
+}
@@ -1,6 +1,16 @@
 package loadbalancer
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -9,45 +19,425 @@ type Metrics struct {
 	activeRequests  *prometheus.GaugeVec
 	serverHealth    *prometheus.GaugeVec
 	serverRIF       *prometheus.GaugeVec
+	serverClassRIF  *prometheus.GaugeVec
+	shedRequests    *prometheus.CounterVec
+
+	concurrencyLimit      *prometheus.GaugeVec
+	concurrencyRTT        *prometheus.GaugeVec
+	concurrencyRejections *prometheus.CounterVec
+
+	splitRequests *prometheus.CounterVec
+	splitDuration *prometheus.HistogramVec
+
+	mirrorRequests *prometheus.CounterVec
+	mirrorDuration *prometheus.HistogramVec
+	mirrorDropped  *prometheus.CounterVec
+
+	backendRequests      *prometheus.CounterVec
+	backendDuration      *prometheus.HistogramVec
+	backendErrors        *prometheus.CounterVec
+	backendBytesSent     *prometheus.CounterVec
+	backendBytesReceived *prometheus.CounterVec
+	selections           *prometheus.CounterVec
+	probesSent           *prometheus.CounterVec
+	probeDuration        *prometheus.HistogramVec
+	probeFailures        *prometheus.CounterVec
+	probeUses            *prometheus.CounterVec
+	probeAge             *prometheus.GaugeVec
+	probePoolSize        prometheus.Gauge
+	serverDrains         *prometheus.CounterVec
+	dnsLookups           *prometheus.CounterVec
+	discoveryUpdates     *prometheus.CounterVec
+}
+
+// MetricsConfig controls where and how metrics are registered. With a nil
+// Registerer, or with Disabled set, each load balancer registers with a
+// private registry that is never scraped; pass prometheus.DefaultRegisterer to
+// export to the default registry. Load balancers sharing a registerer need
+// distinct Namespaces or ConstLabels, or NewLoadBalancer panics.
+type MetricsConfig struct {
+	Registerer  prometheus.Registerer
+	Namespace   string
+	ConstLabels prometheus.Labels
+	Disabled    bool
 }
 
-func NewMetrics() *Metrics {
+// NewMetrics creates and registers the load balancer metrics. It panics if
+// the metrics are already registered with the same Namespace and ConstLabels.
+func NewMetrics(config MetricsConfig) *Metrics {
+	registerer := config.Registerer
+	if config.Disabled || registerer == nil {
+		registerer = prometheus.NewRegistry()
+	}
+
 	m := &Metrics{
 		requestDuration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
-				Name:    "request_duration_seconds",
-				Help:    "Time spent processing request",
-				Buckets: prometheus.DefBuckets,
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "request_duration_seconds",
+				Help:        "Time spent processing request",
+				Buckets:     prometheus.DefBuckets,
 			},
 			[]string{"algorithm"},
 		),
 		activeRequests: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "active_requests",
-				Help: "Number of requests currently being processed",
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "active_requests",
+				Help:        "Number of requests currently being processed",
 			},
 			[]string{"algorithm"},
 		),
 		serverHealth: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "server_health",
-				Help: "Health status of servers",
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "server_health",
+				Help:        "Health status of servers",
 			},
 			[]string{"server_id", "algorithm"},
 		),
 		serverRIF: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "server_rif",
-				Help: "Requests in flight per server",
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "server_rif",
+				Help:        "Requests in flight per server",
+			},
+			[]string{"server_id", "algorithm"},
+		),
+		serverClassRIF: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "server_class_rif",
+				Help:        "Requests in flight per server and criticality class",
+			},
+			[]string{"server_id", "algorithm", "criticality"},
+		),
+		shedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "shed_requests_total",
+				Help:        "Requests rejected by admission control",
+			},
+			[]string{"algorithm", "criticality"},
+		),
+		concurrencyLimit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "concurrency_limit",
+				Help:        "Current adaptive limit on in-flight requests",
+			},
+			[]string{"algorithm"},
+		),
+		concurrencyRTT: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "concurrency_limit_rtt_seconds",
+				Help:        "RTT estimates used by the concurrency limiter",
+			},
+			[]string{"algorithm", "estimate"},
+		),
+		concurrencyRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "concurrency_limit_rejections_total",
+				Help:        "Requests rejected by the concurrency limiter",
+			},
+			[]string{"algorithm"},
+		),
+		splitRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "split_requests_total",
+				Help:        "Requests sent to each side of a traffic split",
+			},
+			[]string{"route", "pool", "status_class"},
+		),
+		splitDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "split_request_duration_seconds",
+				Help:        "Time spent processing split requests per pool",
+				Buckets:     prometheus.DefBuckets,
+			},
+			[]string{"route", "pool"},
+		),
+		mirrorRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "mirror_requests_total",
+				Help:        "Shadow requests sent to mirror pools",
+			},
+			[]string{"route", "pool", "status_class"},
+		),
+		mirrorDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "mirror_request_duration_seconds",
+				Help:        "Latency of shadow requests",
+				Buckets:     prometheus.DefBuckets,
+			},
+			[]string{"route", "pool"},
+		),
+		mirrorDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "mirror_dropped_total",
+				Help:        "Sampled requests that were not mirrored",
+			},
+			[]string{"route", "reason"},
+		),
+		backendRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "backend_requests_total",
+				Help:        "Requests forwarded to each backend by method and status class",
+			},
+			[]string{"server_id", "algorithm", "method", "status_class"},
+		),
+		backendDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "backend_request_duration_seconds",
+				Help:        "Upstream latency per backend",
+				Buckets:     prometheus.DefBuckets,
 			},
 			[]string{"server_id", "algorithm"},
 		),
+		backendErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "backend_errors_total",
+				Help:        "Proxy errors per backend by cause",
+			},
+			[]string{"server_id", "algorithm", "cause"},
+		),
+		backendBytesSent: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "backend_bytes_sent_total",
+				Help:        "Request body bytes sent to each backend",
+			},
+			[]string{"server_id", "algorithm"},
+		),
+		backendBytesReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "backend_bytes_received_total",
+				Help:        "Response body bytes received from each backend",
+			},
+			[]string{"server_id", "algorithm"},
+		),
+		selections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "selections_total",
+				Help:        "Server selection outcomes",
+			},
+			[]string{"algorithm", "outcome"},
+		),
+		probesSent: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "probes_sent_total",
+				Help:        "Health probes sent to each server",
+			},
+			[]string{"server_id"},
+		),
+		probeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "probe_duration_seconds",
+				Help:        "Time taken by health probes",
+				Buckets:     prometheus.DefBuckets,
+			},
+			[]string{"server_id"},
+		),
+		probeFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "probe_failures_total",
+				Help:        "Failed health probes by reason",
+			},
+			[]string{"server_id", "reason"},
+		),
+		probeUses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "probe_uses_total",
+				Help:        "Times a server's latest probe was used in a selection",
+			},
+			[]string{"server_id"},
+		),
+		probeAge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "probe_age_seconds",
+				Help:        "Age of a server's latest probe when it was last used",
+			},
+			[]string{"server_id"},
+		),
+		probePoolSize: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "probe_pool_size",
+				Help:        "Number of servers with a probe result",
+			},
+		),
+		serverDrains: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "server_drains_total",
+				Help:        "Server drains by result",
+			},
+			[]string{"result"},
+		),
+		dnsLookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "dns_lookups_total",
+				Help:        "DNS discovery lookups by name and result",
+			},
+			[]string{"name", "result"},
+		),
+		discoveryUpdates: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   config.Namespace,
+				ConstLabels: config.ConstLabels,
+				Name:        "discovery_updates_total",
+				Help:        "Service discovery updates by source and result",
+			},
+			[]string{"source", "result"},
+		),
 	}
 
-	prometheus.MustRegister(m.requestDuration)
-	prometheus.MustRegister(m.activeRequests)
-	prometheus.MustRegister(m.serverHealth)
-	prometheus.MustRegister(m.serverRIF)
-
+	register(registerer,
+		m.requestDuration,
+		m.activeRequests,
+		m.serverHealth,
+		m.serverRIF,
+		m.serverClassRIF,
+		m.shedRequests,
+		m.concurrencyLimit,
+		m.concurrencyRTT,
+		m.concurrencyRejections,
+		m.splitRequests,
+		m.splitDuration,
+		m.mirrorRequests,
+		m.mirrorDuration,
+		m.mirrorDropped,
+		m.backendRequests,
+		m.backendDuration,
+		m.backendErrors,
+		m.backendBytesSent,
+		m.backendBytesReceived,
+		m.selections,
+		m.probesSent,
+		m.probeDuration,
+		m.probeFailures,
+		m.probeUses,
+		m.probeAge,
+		m.probePoolSize,
+		m.serverDrains,
+		m.dnsLookups,
+		m.discoveryUpdates,
+	)
 	return m
 }
+
+func register(registerer prometheus.Registerer, collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			panic(fmt.Errorf("registering load balancer metrics: %w", err))
+		}
+	}
+}
+
+// removeServer deletes every series labelled with serverID.
+func (m *Metrics) removeServer(serverID string) {
+	labels := prometheus.Labels{"server_id": serverID}
+	m.serverHealth.DeletePartialMatch(labels)
+	m.serverRIF.DeletePartialMatch(labels)
+	m.serverClassRIF.DeletePartialMatch(labels)
+	m.backendRequests.DeletePartialMatch(labels)
+	m.backendDuration.DeletePartialMatch(labels)
+	m.backendErrors.DeletePartialMatch(labels)
+	m.backendBytesSent.DeletePartialMatch(labels)
+	m.backendBytesReceived.DeletePartialMatch(labels)
+	m.probesSent.DeletePartialMatch(labels)
+	m.probeDuration.DeletePartialMatch(labels)
+	m.probeFailures.DeletePartialMatch(labels)
+	m.probeUses.DeletePartialMatch(labels)
+	m.probeAge.DeletePartialMatch(labels)
+}
+
+func (m *Metrics) observeBackend(serverID, algorithm, method string, recorder *statusRecorder, sent *countingReader, err error, duration time.Duration) {
+	m.backendDuration.WithLabelValues(serverID, algorithm).Observe(duration.Seconds())
+	m.backendBytesReceived.WithLabelValues(serverID, algorithm).Add(float64(recorder.bytes))
+	if sent != nil {
+		m.backendBytesSent.WithLabelValues(serverID, algorithm).Add(float64(sent.n.Load()))
+	}
+
+	if err != nil {
+		m.backendErrors.WithLabelValues(serverID, algorithm, errorCause(err)).Inc()
+		m.backendRequests.WithLabelValues(serverID, algorithm, method, "error").Inc()
+		return
+	}
+	m.backendRequests.WithLabelValues(serverID, algorithm, method, statusClass(recorder.status)).Inc()
+}
+
+// errorCause classifies a proxy error as dial, timeout, reset, canceled or
+// other.
+func errorCause(err error) string {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), os.IsTimeout(err):
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "dial"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	default:
+		return "other"
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,144 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorConfig copies a percentage of a route's requests to a shadow pool.
+// Shadow requests are fire-and-forget: their responses are discarded and
+// only recorded in the mirror metrics. Requests with bodies larger than
+// MaxBodyBytes are not mirrored, and at most MaxConcurrent shadow requests
+// are in flight at once.
+type MirrorConfig struct {
+	Pool          string
+	Percent       float64
+	MaxBodyBytes  int64
+	MaxConcurrent int
+	Timeout       time.Duration
+}
+
+type mirror struct {
+	config MirrorConfig
+	slots  chan struct{}
+	client *http.Client
+}
+
+func newMirror(config MirrorConfig) *mirror {
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = 64 << 10
+	}
+	if config.MaxConcurrent == 0 {
+		config.MaxConcurrent = 16
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &mirror{
+		config: config,
+		slots:  make(chan struct{}, config.MaxConcurrent),
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+func (rt *Router) validateMirror(route *Route) error {
+	if route.Mirror == nil {
+		return nil
+	}
+	if _, ok := rt.pools[route.Mirror.Pool]; !ok {
+		return fmt.Errorf("route %q: unknown mirror pool %q", route.Name, route.Mirror.Pool)
+	}
+	if route.Mirror.Percent < 0 || route.Mirror.Percent > 100 {
+		return fmt.Errorf("route %q: mirror percent must be between 0 and 100", route.Name)
+	}
+	return nil
+}
+
+// mirrorRequest starts a shadow copy of r if the route samples it. The body
+// of r is buffered so both the live and shadow requests can read it.
+func (rt *Router) mirrorRequest(route *Route, r *http.Request) {
+	m := route.mirror
+	if m == nil || rand.Float64()*100 >= m.config.Percent {
+		return
+	}
+
+	shadowLB := rt.Pool(m.config.Pool)
+	metrics := shadowLB.metrics
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		buffered, err := io.ReadAll(io.LimitReader(r.Body, m.config.MaxBodyBytes+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buffered), r.Body), r.Body}
+		if err != nil || int64(len(buffered)) > m.config.MaxBodyBytes {
+			metrics.mirrorDropped.WithLabelValues(route.Name, "body_too_large").Inc()
+			return
+		}
+		body = buffered
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		metrics.mirrorDropped.WithLabelValues(route.Name, "concurrency").Inc()
+		return
+	}
+
+	server := shadowLB.SelectServer()
+	if server == nil {
+		<-m.slots
+		metrics.mirrorDropped.WithLabelValues(route.Name, "no_server").Inc()
+		return
+	}
+
+	shadow, err := http.NewRequestWithContext(context.Background(), r.Method,
+		"http://"+server.Address+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		<-m.slots
+		return
+	}
+	shadow.Header = r.Header.Clone()
+	shadow.Host = r.Host
+	shadow.Header.Set("X-Shadow-Request", "true")
+
+	go func() {
+		defer func() { <-m.slots }()
+		rt.sendShadow(route, m, shadowLB, server, shadow)
+	}()
+}
+
+func (rt *Router) sendShadow(route *Route, m *mirror, lb *LoadBalancer, server *Server, req *http.Request) {
+	atomic.AddInt32(&server.RIF, 1)
+	defer atomic.AddInt32(&server.RIF, -1)
+
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	duration := time.Since(start)
+
+	status := "error"
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		status = statusClass(resp.StatusCode)
+	} else {
+		rt.logger.Debug("Shadow request failed",
+			slog.String("route", route.Name),
+			slog.String("server", server.ID),
+			slog.String("error", err.Error()))
+	}
+
+	lb.metrics.mirrorRequests.WithLabelValues(route.Name, m.config.Pool, status).Inc()
+	lb.metrics.mirrorDuration.WithLabelValues(route.Name, m.config.Pool).Observe(duration.Seconds())
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
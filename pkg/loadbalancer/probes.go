@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ProbeSnapshot is a point-in-time copy of a server's latest probe result.
+type ProbeSnapshot struct {
+	ServerID  string    `json:"server_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Age       float64   `json:"age_seconds"`
+	RIF       int32     `json:"rif"`
+	Latency   int64     `json:"latency_ms"`
+	IsHealthy bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	Uses      int64     `json:"uses"`
+}
+
+// useProbe records that a selection read server's latest probe. It must be
+// called with lb.mutex held.
+func (lb *LoadBalancer) useProbe(server *Server) {
+	result, ok := lb.probePool[server.ID]
+	if !ok {
+		return
+	}
+	result.uses.Add(1)
+	lb.metrics.probeUses.WithLabelValues(server.ID).Inc()
+	lb.metrics.probeAge.WithLabelValues(server.ID).Set(time.Since(result.Timestamp).Seconds())
+}
+
+// ProbePool returns the latest probe result for each server, keyed by ID.
+func (lb *LoadBalancer) ProbePool() map[string]ProbeSnapshot {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	now := time.Now()
+	pool := make(map[string]ProbeSnapshot, len(lb.probePool))
+	for id, result := range lb.probePool {
+		pool[id] = ProbeSnapshot{
+			ServerID:  id,
+			Timestamp: result.Timestamp,
+			Age:       now.Sub(result.Timestamp).Seconds(),
+			RIF:       result.RIF,
+			Latency:   result.Latency,
+			IsHealthy: result.IsHealthy,
+			Error:     result.Error,
+			Uses:      result.uses.Load(),
+		}
+	}
+	return pool
+}
+
+// ProbePoolHandler serves ProbePool as JSON.
+func (lb *LoadBalancer) ProbePoolHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, lb.ProbePool())
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,289 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+)
+
+// ServerDiff lists the IDs of the servers changed by SetServers.
+type ServerDiff struct {
+	Added    []string
+	Removed  []string
+	Replaced []string
+	Updated  []string
+}
+
+func (d ServerDiff) Empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Replaced)+len(d.Updated) == 0
+}
+
+// adminSource is the source of servers added through the admin API, which
+// SetServers never lists.
+const adminSource = "admin"
+
+// SetServers makes servers the set of servers from source, in a single step
+// so no request sees a mix of the old and new sets. Servers from other
+// sources are left alone. Servers from config have the empty source, servers
+// added through the admin API have their own, and discovery uses its own.
+//
+// A listed server whose ID and address match an existing one only updates
+// the existing server's weight, zone and labels, keeping its RIF, probe
+// results and state; a server SetServers was draining is made active again.
+// A server whose address changed is replaced, and requests already sent to
+// the old address finish there. A state set through the admin API is kept
+// either way.
+// Servers that are no longer listed stop receiving requests at once and are
+// drained in the background for up to drainTimeout, then removed. With a
+// zero drainTimeout they are removed immediately.
+//
+// Nothing is changed if any listed server is invalid, listed twice or has
+// the ID of a server from another source.
+func (lb *LoadBalancer) SetServers(source string, servers []*Server, drainTimeout time.Duration) (ServerDiff, error) {
+	listed, err := validateServers(source, servers)
+	if err != nil {
+		return ServerDiff{}, err
+	}
+
+	lb.mutex.Lock()
+	diff, removed, err := lb.setServers(source, servers, listed, drainTimeout)
+	lb.mutex.Unlock()
+	if err != nil {
+		return ServerDiff{}, err
+	}
+
+	lb.drainAll(removed, drainTimeout)
+	return diff, nil
+}
+
+// validateServers checks servers for SetServers, marks them as coming from
+// source and returns the set of their IDs.
+func validateServers(source string, servers []*Server) (map[string]bool, error) {
+	listed := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		if err := validateServer(server); err != nil {
+			return nil, err
+		}
+		if listed[server.ID] {
+			return nil, fmt.Errorf("%w: %s", ErrServerExists, server.ID)
+		}
+		listed[server.ID] = true
+		server.source = source
+	}
+	return listed, nil
+}
+
+// setServers does the work of SetServers and returns the servers to drain.
+// It must be called with lb.mutex held, and changes nothing when it fails.
+func (lb *LoadBalancer) setServers(source string, servers []*Server, listed map[string]bool, drainTimeout time.Duration) (ServerDiff, []*Server, error) {
+	for _, server := range servers {
+		if existing := lb.serverByID(server.ID); existing != nil && existing.source != source {
+			return ServerDiff{}, nil, fmt.Errorf("%w: %s", ErrServerExists, server.ID)
+		}
+	}
+
+	var diff ServerDiff
+	var removed []*Server
+	for _, server := range lb.servers {
+		if server.source == source && !listed[server.ID] {
+			diff.Removed = append(diff.Removed, server.ID)
+			removed = append(removed, server)
+		}
+	}
+	for _, server := range removed {
+		if drainTimeout > 0 {
+			server.State = ServerDraining
+			server.adminState = false
+		} else {
+			lb.removeServer(server)
+		}
+	}
+
+	for _, server := range servers {
+		existing := lb.serverByID(server.ID)
+		switch {
+		case existing == nil:
+			server.removed = false
+			lb.servers = append(lb.servers, server)
+			diff.Added = append(diff.Added, server.ID)
+		case existing.Address != server.Address:
+			for i := range lb.servers {
+				if lb.servers[i] == existing {
+					lb.servers[i] = server
+				}
+			}
+			existing.removed = true
+			server.removed = false
+			if existing.adminState {
+				server.State = existing.State
+				server.adminState = true
+			}
+			delete(lb.probePool, server.ID)
+			lb.metrics.probePoolSize.Set(float64(len(lb.probePool)))
+			diff.Replaced = append(diff.Replaced, server.ID)
+		case existing.Weight != server.Weight || existing.State == ServerDraining && !existing.adminState ||
+			existing.Zone != server.Zone || !maps.Equal(existing.Labels, server.Labels):
+			existing.Weight = server.Weight
+			existing.Zone = server.Zone
+			existing.Labels = server.Labels
+			if existing.State == ServerDraining && !existing.adminState {
+				existing.State = ServerActive
+			}
+			diff.Updated = append(diff.Updated, server.ID)
+		}
+	}
+
+	if drainTimeout == 0 {
+		removed = nil
+	}
+	return diff, removed, nil
+}
+
+// drainAll drains the servers setServers took out of rotation in the
+// background.
+func (lb *LoadBalancer) drainAll(servers []*Server, timeout time.Duration) {
+	for _, server := range servers {
+		go lb.drainRemoved(server, timeout)
+	}
+}
+
+// drainRemoved drains a server dropped by SetServers and removes it even if
+// the drain times out.
+func (lb *LoadBalancer) drainRemoved(server *Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if _, err := lb.drain(ctx, server); errors.Is(err, context.DeadlineExceeded) {
+		lb.mutex.Lock()
+		if server.State == ServerDraining {
+			lb.removeServer(server)
+		}
+		lb.mutex.Unlock()
+	}
+}
+
+// SetProbing changes the probe interval, timeout and health check path. A new
+// interval takes effect after the next round of probes.
+func (lb *LoadBalancer) SetProbing(interval, timeout time.Duration, healthCheckPath string) error {
+	if err := validateProbing(interval, timeout); err != nil {
+		return err
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.setProbing(interval, timeout, healthCheckPath)
+	return nil
+}
+
+func validateProbing(interval, timeout time.Duration) error {
+	if interval <= 0 || timeout <= 0 {
+		return errors.New("probe interval and timeout must be positive")
+	}
+	return nil
+}
+
+// setProbing must be called with lb.mutex held.
+func (lb *LoadBalancer) setProbing(interval, timeout time.Duration, healthCheckPath string) {
+	if lb.config.ProbeInterval != interval || lb.config.ProbeTimeout != timeout || lb.config.HealthCheckPath != healthCheckPath {
+		lb.logger.Info("Probing changed",
+			slog.Duration("interval", interval),
+			slog.Duration("timeout", timeout),
+			slog.String("path", healthCheckPath))
+	}
+	lb.config.ProbeInterval = interval
+	lb.config.ProbeTimeout = timeout
+	lb.config.HealthCheckPath = healthCheckPath
+}
+
+// SetSelection changes how many servers Prequal samples per request and the
+// RIF quantile above which a server is hot. A zero qrif uses the default.
+func (lb *LoadBalancer) SetSelection(choices int, qrif float64) error {
+	qrif, err := validateSelection(choices, qrif)
+	if err != nil {
+		return err
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.setSelection(choices, qrif)
+	return nil
+}
+
+// validateSelection checks the selection settings and returns qrif with the
+// default filled in.
+func validateSelection(choices int, qrif float64) (float64, error) {
+	if qrif == 0 {
+		qrif = defaultQRIF
+	}
+	if choices < 1 {
+		return 0, errors.New("selection choices must be at least 1")
+	}
+	if qrif < 0 || qrif > 1 {
+		return 0, errors.New("qrif must be within [0, 1]")
+	}
+	return qrif, nil
+}
+
+// setSelection must be called with lb.mutex held.
+func (lb *LoadBalancer) setSelection(choices int, qrif float64) {
+	if lb.config.SelectionChoices != choices || lb.config.QRIF != qrif {
+		lb.logger.Info("Selection changed",
+			slog.Int("choices", choices),
+			slog.Float64("qrif", qrif))
+	}
+	lb.config.SelectionChoices = choices
+	lb.config.QRIF = qrif
+}
+
+// PoolSettings are the settings Reconfigure changes, along with a source's
+// servers. An empty Algorithm means Prequal and a zero QRIF the default.
+type PoolSettings struct {
+	Algorithm        Algorithm
+	SelectionChoices int
+	QRIF             float64
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	HealthCheckPath  string
+}
+
+// Reconfigure applies settings and makes servers the set of servers from
+// source, as SetServers does, all in one step under the load balancer's lock,
+// so no request sees some settings changed and others not. Everything is
+// validated before anything changes, and on error nothing is changed.
+func (lb *LoadBalancer) Reconfigure(settings PoolSettings, source string, servers []*Server, drainTimeout time.Duration) (ServerDiff, error) {
+	algorithm := settings.Algorithm
+	if algorithm == "" {
+		algorithm = AlgorithmPrequal
+	}
+	if !algorithm.valid() {
+		return ServerDiff{}, fmt.Errorf("%w %q", ErrUnknownAlgorithm, algorithm)
+	}
+	qrif, err := validateSelection(settings.SelectionChoices, settings.QRIF)
+	if err != nil {
+		return ServerDiff{}, err
+	}
+	if err := validateProbing(settings.ProbeInterval, settings.ProbeTimeout); err != nil {
+		return ServerDiff{}, err
+	}
+	listed, err := validateServers(source, servers)
+	if err != nil {
+		return ServerDiff{}, err
+	}
+
+	lb.mutex.Lock()
+	diff, removed, err := lb.setServers(source, servers, listed, drainTimeout)
+	if err != nil {
+		lb.mutex.Unlock()
+		return ServerDiff{}, err
+	}
+	lb.setSelection(settings.SelectionChoices, qrif)
+	lb.setProbing(settings.ProbeInterval, settings.ProbeTimeout, settings.HealthCheckPath)
+	lb.setAlgorithm(algorithm)
+	lb.mutex.Unlock()
+
+	lb.drainAll(removed, drainTimeout)
+	return diff, nil
+}
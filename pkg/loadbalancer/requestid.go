@@ -0,0 +1,61 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// withRequestID accepts the client's request ID if it looks sane, or
+// generates one, and makes it visible to the backend, the client and every
+// log line for the request.
+func (lb *LoadBalancer) withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	header := lb.config.RequestIDHeader
+
+	id := r.Header.Get(header)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+	r.Header.Set(header, id)
+	w.Header().Set(header, id)
+	return r
+}
+
+// RequestIDFromContext returns the request ID assigned by the load balancer,
+// or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns lb.logger annotated with r's request ID.
+func (lb *LoadBalancer) requestLogger(r *http.Request) *slog.Logger {
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		return lb.logger.With(slog.String("request_id", id))
+	}
+	return lb.logger
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package loadbalancer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupTimeFormat = "20060102T150405.000000000"
+	rotateRetry      = time.Second
+)
+
+// rotatingFile is an append-only file that is renamed aside with a
+// timestamp suffix once it exceeds maxSize bytes or is older than maxAge.
+// A zero maxSize or maxAge disables that trigger. A file's age counts from
+// the last rotation, taken from the newest backup's suffix, since file
+// systems don't portably record creation times; without backups it counts
+// from when the file was opened.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+	retryAt time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.started = time.Now()
+	if rf.size > 0 {
+		rf.started = rf.lastRotation()
+	}
+	return nil
+}
+
+// lastRotation returns the time in the newest backup's suffix, or now if
+// there are no backups.
+func (rf *rotatingFile) lastRotation() time.Time {
+	backups := rf.backups()
+	if len(backups) == 0 {
+		return time.Now()
+	}
+	suffix := strings.TrimPrefix(backups[len(backups)-1], rf.path+".")
+	t, _ := time.ParseInLocation(backupTimeFormat, suffix, time.Local)
+	return t
+}
+
+// backups returns the file's backups, oldest first. Only files whose suffix
+// is a backup timestamp count, so unrelated files sharing the name, such as
+// access.log.gz, are never taken for backups.
+func (rf *rotatingFile) backups() []string {
+	entries, err := os.ReadDir(filepath.Dir(rf.path))
+	if err != nil {
+		return nil
+	}
+
+	prefix := filepath.Base(rf.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.ParseInLocation(backupTimeFormat, suffix, time.Local); err == nil {
+			backups = append(backups, rf.path+"."+suffix)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// Write appends p, rotating the file first when it is due. If rotating
+// fails, p still goes to the current file and rotation is retried a second
+// later. If the file couldn't be reopened, each write tries again.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.shouldRotate(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			rf.retryAt = time.Now().Add(rotateRetry)
+		}
+	}
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) shouldRotate(next int64) bool {
+	if rf.size == 0 || rf.file == nil || time.Now().Before(rf.retryAt) {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+next > rf.maxSize {
+		return true
+	}
+	return rf.maxAge > 0 && time.Since(rf.started) > rf.maxAge
+}
+
+// rotate renames the file aside and opens a new one at the same path. The
+// path is reopened even when closing or renaming fails, so logging carries on
+// in the current file instead of failing until a restart.
+func (rf *rotatingFile) rotate() error {
+	closeErr := rf.file.Close()
+	rf.file = nil
+
+	backup := rf.path + "." + time.Now().Format(backupTimeFormat)
+	renameErr := os.Rename(rf.path, backup)
+	if renameErr == nil {
+		rf.pruneBackups()
+	}
+
+	return errors.Join(closeErr, renameErr, rf.open())
+}
+
+func (rf *rotatingFile) pruneBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+
+	backups := rf.backups()
+	if len(backups) <= rf.maxBackups {
+		return
+	}
+
+	for _, backup := range backups[:len(backups)-rf.maxBackups] {
+		os.Remove(backup)
+	}
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	return rf.file.Close()
+}
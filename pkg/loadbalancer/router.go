@@ -0,0 +1,237 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RouteMatch struct {
+	// Host matches the request host exactly, or any subdomain when it starts
+	// with "*.".
+	Host       string
+	PathPrefix string
+	PathRegex  string
+	Methods    []string
+	// Headers must all be present; an empty value matches any value.
+	Headers map[string]string
+}
+
+// Route forwards matching requests to a named pool, or across several pools by
+// weight when Splits is set. StripPrefix removes Match.PathPrefix before
+// forwarding. RewritePath replaces the part of the path matched by
+// Match.PathRegex (with $1-style expansion), or the prefix when only
+// Match.PathPrefix is set.
+type Route struct {
+	Name        string
+	Match       RouteMatch
+	Pool        string
+	Splits      []Split
+	SplitKey    SplitKey
+	Mirror      *MirrorConfig
+	StripPrefix bool
+	RewritePath string
+
+	pathRegex *regexp.Regexp
+	mirror    *mirror
+}
+
+type Router struct {
+	pools  map[string]*LoadBalancer
+	routes []*Route
+	logger *slog.Logger
+	mutex  sync.RWMutex
+}
+
+func NewRouter(logger *slog.Logger) *Router {
+	return &Router{
+		pools:  make(map[string]*LoadBalancer),
+		routes: make([]*Route, 0),
+		logger: logger,
+	}
+}
+
+func (rt *Router) AddPool(name string, lb *LoadBalancer) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.pools[name] = lb
+}
+
+func (rt *Router) Pool(name string) *LoadBalancer {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	return rt.pools[name]
+}
+
+func (rt *Router) Pools() map[string]*LoadBalancer {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	pools := make(map[string]*LoadBalancer, len(rt.pools))
+	for name, lb := range rt.pools {
+		pools[name] = lb
+	}
+	return pools
+}
+
+// AddRoute appends a route. Routes are matched in the order they were added.
+func (rt *Router) AddRoute(route Route) error {
+	if route.Match.PathRegex != "" {
+		re, err := regexp.Compile(route.Match.PathRegex)
+		if err != nil {
+			return fmt.Errorf("route %q: invalid path regex: %w", route.Name, err)
+		}
+		route.pathRegex = re
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if len(route.Splits) > 0 {
+		route.Splits = append([]Split(nil), route.Splits...)
+		if err := rt.validateSplits(route.Name, route.Splits); err != nil {
+			return err
+		}
+	} else if _, ok := rt.pools[route.Pool]; !ok {
+		return fmt.Errorf("route %q: unknown pool %q", route.Name, route.Pool)
+	}
+	if err := rt.validateMirror(&route); err != nil {
+		return err
+	}
+	if route.Mirror != nil {
+		route.mirror = newMirror(*route.Mirror)
+	}
+	rt.routes = append(rt.routes, &route)
+	return nil
+}
+
+func (rt *Router) StartProbing() {
+	for _, lb := range rt.Pools() {
+		lb.StartProbing()
+	}
+}
+
+func (rt *Router) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, lb := range rt.Pools() {
+		errs = append(errs, lb.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// match returns the route for r, the pool to send it to and whether the pool
+// was picked from the route's splits, which SetSplitWeights may be changing.
+func (rt *Router) match(r *http.Request) (*Route, string, bool) {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	for _, route := range rt.routes {
+		if !route.matches(r) {
+			continue
+		}
+		if len(route.Splits) > 0 {
+			return route, route.pickSplit(r), true
+		}
+		return route, route.Pool, false
+	}
+	return nil, "", false
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, pool, split := rt.match(r)
+	if route == nil {
+		http.Error(w, "No matching route", http.StatusNotFound)
+		return
+	}
+
+	r = route.rewrite(r)
+	rt.mirrorRequest(route, r)
+
+	lb := rt.Pool(pool)
+	if !split {
+		lb.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	lb.ServeHTTP(recorder, r)
+	lb.metrics.observeSplit(route.Name, pool, recorder.status, time.Since(start))
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	match := route.Match
+
+	if match.Host != "" && !matchHost(match.Host, r.Host) {
+		return false
+	}
+	if match.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, match.PathPrefix) {
+		return false
+	}
+	if route.pathRegex != nil && !route.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(match.Methods) > 0 && !containsFold(match.Methods, r.Method) {
+		return false
+	}
+	for name, value := range match.Headers {
+		got := r.Header.Get(name)
+		if got == "" || (value != "" && got != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (route *Route) rewrite(r *http.Request) *http.Request {
+	path := r.URL.Path
+	switch {
+	case route.RewritePath != "" && route.pathRegex != nil:
+		path = route.pathRegex.ReplaceAllString(path, route.RewritePath)
+	case route.RewritePath != "" && route.Match.PathPrefix != "":
+		path = route.RewritePath + strings.TrimPrefix(path, route.Match.PathPrefix)
+	case route.StripPrefix && route.Match.PathPrefix != "":
+		path = strings.TrimPrefix(path, route.Match.PathPrefix)
+	}
+
+	if path == r.URL.Path {
+		return r
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	rewritten := r.Clone(r.Context())
+	rewritten.URL.Path = path
+	rewritten.URL.RawPath = ""
+	return rewritten
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Split struct {
+	Pool   string
+	Weight int
+}
+
+// SplitKey keeps a user on the same side of a split by hashing a request
+// header or cookie. Requests without the key are split at random.
+type SplitKey struct {
+	Header string
+	Cookie string
+}
+
+func (rt *Router) validateSplits(routeName string, splits []Split) error {
+	total := 0
+	for _, split := range splits {
+		if _, ok := rt.pools[split.Pool]; !ok {
+			return fmt.Errorf("route %q: unknown pool %q", routeName, split.Pool)
+		}
+		if split.Weight < 0 {
+			return fmt.Errorf("route %q: negative weight for pool %q", routeName, split.Pool)
+		}
+		total += split.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("route %q: split weights sum to zero", routeName)
+	}
+	return nil
+}
+
+// SetSplitWeights changes the weights of a split route at runtime. Pools not
+// present in weights keep their current weight.
+func (rt *Router) SetSplitWeights(routeName string, weights map[string]int) error {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	for _, route := range rt.routes {
+		if route.Name != routeName {
+			continue
+		}
+		if len(route.Splits) == 0 {
+			return fmt.Errorf("route %q has no splits", routeName)
+		}
+
+		splits := append([]Split(nil), route.Splits...)
+		for i := range splits {
+			if weight, ok := weights[splits[i].Pool]; ok {
+				splits[i].Weight = weight
+			}
+		}
+		for pool := range weights {
+			if !hasSplit(splits, pool) {
+				return fmt.Errorf("route %q has no split for pool %q", routeName, pool)
+			}
+		}
+		if err := rt.validateSplits(routeName, splits); err != nil {
+			return err
+		}
+
+		route.Splits = splits
+		return nil
+	}
+
+	return fmt.Errorf("unknown route %q", routeName)
+}
+
+func hasSplit(splits []Split, pool string) bool {
+	for _, split := range splits {
+		if split.Pool == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// pickSplit must be called with the router's mutex held.
+func (route *Route) pickSplit(r *http.Request) string {
+	total := 0
+	for _, split := range route.Splits {
+		total += split.Weight
+	}
+
+	var point int
+	if key := route.SplitKey.value(r); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(route.Name + ":" + key))
+		point = int(h.Sum32() % uint32(total))
+	} else {
+		point = rand.Intn(total)
+	}
+
+	for _, split := range route.Splits {
+		if point < split.Weight {
+			return split.Pool
+		}
+		point -= split.Weight
+	}
+	return route.Splits[len(route.Splits)-1].Pool
+}
+
+func (key SplitKey) value(r *http.Request) string {
+	if key.Header != "" {
+		if value := r.Header.Get(key.Header); value != "" {
+			return value
+		}
+	}
+	if key.Cookie != "" {
+		if cookie, err := r.Cookie(key.Cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func (m *Metrics) observeSplit(route, pool string, status int, duration time.Duration) {
+	m.splitRequests.WithLabelValues(route, pool, statusClass(status)).Inc()
+	m.splitDuration.WithLabelValues(route, pool).Observe(duration.Seconds())
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -0,0 +1,270 @@
+package loadbalancer
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsBucketWidth = 10 * time.Second
+	statsBuckets     = 90
+
+	latencyBins    = 64
+	latencyBinBase = 100 * time.Microsecond
+	latencyBinStep = 1.25
+)
+
+// statsWindows are the rolling windows reported in snapshots.
+var statsWindows = []struct {
+	name   string
+	length time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+type statsBucket struct {
+	index        atomic.Int64
+	requests     atomic.Uint64
+	failures     atomic.Uint64
+	latencySum   atomic.Int64
+	latencyCount atomic.Uint64
+	latencies    [latencyBins]atomic.Uint32
+}
+
+// rollingWindow keeps 15 minutes of request counts and latency histograms in
+// 10 second buckets. Percentiles are estimated from exponential bins, so they
+// are accurate to within a quarter of the reported value.
+//
+// Buckets are updated with atomics. The first request of a new 10 seconds
+// clears the bucket it reuses, and a request recorded in that bucket while it
+// is being cleared may be lost.
+type rollingWindow struct {
+	buckets [statsBuckets]statsBucket
+}
+
+func (rw *rollingWindow) bucket(now time.Time) *statsBucket {
+	index := now.UnixNano() / int64(statsBucketWidth)
+	b := &rw.buckets[index%statsBuckets]
+	if old := b.index.Load(); old < index && b.index.CompareAndSwap(old, index) {
+		b.requests.Store(0)
+		b.failures.Store(0)
+		b.latencySum.Store(0)
+		b.latencyCount.Store(0)
+		for i := range b.latencies {
+			b.latencies[i].Store(0)
+		}
+	}
+	return b
+}
+
+func (rw *rollingWindow) record(now time.Time, latency time.Duration, failed, proxied bool) {
+	b := rw.bucket(now)
+	b.requests.Add(1)
+	if failed {
+		b.failures.Add(1)
+	}
+	if proxied {
+		b.latencySum.Add(int64(latency))
+		b.latencyCount.Add(1)
+		b.latencies[latencyBin(latency)].Add(1)
+	}
+}
+
+func latencyBin(latency time.Duration) int {
+	if latency <= latencyBinBase {
+		return 0
+	}
+	bin := int(math.Ceil(math.Log(float64(latency)/float64(latencyBinBase)) / math.Log(latencyBinStep)))
+	return min(bin, latencyBins-1)
+}
+
+func latencyBinUpper(bin int) time.Duration {
+	return time.Duration(float64(latencyBinBase) * math.Pow(latencyBinStep, float64(bin)))
+}
+
+// WindowStats summarizes the requests seen in one rolling window. Latencies
+// are in seconds.
+type WindowStats struct {
+	Requests       uint64  `json:"requests"`
+	Failures       uint64  `json:"failures"`
+	RequestRate    float64 `json:"requests_per_second"`
+	ErrorRate      float64 `json:"error_rate"`
+	AverageLatency float64 `json:"average_latency_seconds"`
+	P50            float64 `json:"p50_seconds"`
+	P90            float64 `json:"p90_seconds"`
+	P99            float64 `json:"p99_seconds"`
+}
+
+func (rw *rollingWindow) summarize(now time.Time, length time.Duration) WindowStats {
+	current := now.UnixNano() / int64(statsBucketWidth)
+	oldest := current - int64(length/statsBucketWidth) + 1
+
+	var stats WindowStats
+	var latencySum time.Duration
+	var latencyCount uint64
+	var latencies [latencyBins]uint64
+	for i := range rw.buckets {
+		b := &rw.buckets[i]
+		if index := b.index.Load(); index < oldest || index > current {
+			continue
+		}
+		stats.Requests += b.requests.Load()
+		stats.Failures += b.failures.Load()
+		latencySum += time.Duration(b.latencySum.Load())
+		latencyCount += b.latencyCount.Load()
+		for bin := range b.latencies {
+			latencies[bin] += uint64(b.latencies[bin].Load())
+		}
+	}
+
+	stats.RequestRate = float64(stats.Requests) / length.Seconds()
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Failures) / float64(stats.Requests)
+	}
+	if latencyCount > 0 {
+		stats.AverageLatency = (latencySum / time.Duration(latencyCount)).Seconds()
+		stats.P50 = percentile(latencies, latencyCount, 0.50)
+		stats.P90 = percentile(latencies, latencyCount, 0.90)
+		stats.P99 = percentile(latencies, latencyCount, 0.99)
+	}
+	return stats
+}
+
+func percentile(latencies [latencyBins]uint64, total uint64, q float64) float64 {
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for bin, count := range latencies {
+		seen += count
+		if seen >= rank {
+			return latencyBinUpper(bin).Seconds()
+		}
+	}
+	return latencyBinUpper(latencyBins - 1).Seconds()
+}
+
+func (rw *rollingWindow) snapshot(now time.Time) map[string]WindowStats {
+	windows := make(map[string]WindowStats, len(statsWindows))
+	for _, window := range statsWindows {
+		windows[window.name] = rw.summarize(now, window.length)
+	}
+	return windows
+}
+
+type serverStats struct {
+	requests atomic.Uint64
+	failures atomic.Uint64
+	window   rollingWindow
+}
+
+func newStats() *Stats {
+	return &Stats{}
+}
+
+// recordFailure counts a request the load balancer rejected before it
+// reached a backend.
+func (s *Stats) recordFailure() {
+	atomic.AddUint64(&s.FailedRequests, 1)
+	s.window.record(time.Now(), 0, true, false)
+}
+
+// recordRequest counts a request that was proxied, including its retries.
+func (s *Stats) recordRequest(latency time.Duration, failed bool) {
+	if failed {
+		atomic.AddUint64(&s.FailedRequests, 1)
+	} else {
+		atomic.AddUint64(&s.SuccessfulRequests, 1)
+	}
+	s.latencySum.Add(int64(latency))
+	s.latencyCount.Add(1)
+	s.window.record(time.Now(), latency, failed, true)
+}
+
+// recordAttempt counts one attempt against a single server.
+func (s *Stats) recordAttempt(serverID string, latency time.Duration, failed bool) {
+	value, ok := s.servers.Load(serverID)
+	if !ok {
+		value, _ = s.servers.LoadOrStore(serverID, &serverStats{})
+	}
+	server := value.(*serverStats)
+	server.requests.Add(1)
+	if failed {
+		server.failures.Add(1)
+	}
+	server.window.record(time.Now(), latency, failed, true)
+}
+
+func (s *Stats) removeServer(serverID string) {
+	s.servers.Delete(serverID)
+}
+
+// StatsSnapshot is a point-in-time copy of a LoadBalancer's Stats.
+type StatsSnapshot struct {
+	Algorithm          Algorithm              `json:"algorithm"`
+	TotalRequests      uint64                 `json:"total_requests"`
+	SuccessfulRequests uint64                 `json:"successful_requests"`
+	FailedRequests     uint64                 `json:"failed_requests"`
+	AverageLatency     float64                `json:"average_latency_seconds"`
+	Windows            map[string]WindowStats `json:"windows"`
+	Servers            []ServerStats          `json:"servers"`
+}
+
+// ServerStats is the per-server part of a StatsSnapshot. Requests and
+// Failures count attempts, so a retried request counts against every server
+// it was sent to.
+type ServerStats struct {
+	ServerInfo
+	Requests uint64                 `json:"requests"`
+	Failures uint64                 `json:"failures"`
+	Windows  map[string]WindowStats `json:"windows"`
+}
+
+func (lb *LoadBalancer) Stats() StatsSnapshot {
+	now := time.Now()
+
+	lb.mutex.RLock()
+	servers := make([]ServerStats, 0, len(lb.servers))
+	for _, server := range lb.servers {
+		servers = append(servers, ServerStats{ServerInfo: server.info()})
+	}
+	lb.mutex.RUnlock()
+
+	s := lb.stats
+	snapshot := StatsSnapshot{
+		Algorithm:          lb.Algorithm(),
+		TotalRequests:      atomic.LoadUint64(&s.TotalRequests),
+		SuccessfulRequests: atomic.LoadUint64(&s.SuccessfulRequests),
+		FailedRequests:     atomic.LoadUint64(&s.FailedRequests),
+		Servers:            servers,
+	}
+
+	if count := s.latencyCount.Load(); count > 0 {
+		snapshot.AverageLatency = (time.Duration(s.latencySum.Load()) / time.Duration(count)).Seconds()
+	}
+	s.averageMutex.Lock()
+	s.AverageLatency = snapshot.AverageLatency
+	s.averageMutex.Unlock()
+	snapshot.Windows = s.window.snapshot(now)
+	for i := range snapshot.Servers {
+		server := &snapshot.Servers[i]
+		if value, ok := s.servers.Load(server.ID); ok {
+			stats := value.(*serverStats)
+			server.Requests = stats.requests.Load()
+			server.Failures = stats.failures.Load()
+			server.Windows = stats.window.snapshot(now)
+		} else {
+			server.Windows = (&rollingWindow{}).snapshot(now)
+		}
+	}
+	return snapshot
+}
+
+// StatusHandler serves Stats as JSON.
+func (lb *LoadBalancer) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, lb.Stats())
+	})
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StickyConfig pins clients to a backend with a cookie naming the chosen
+// Server.ID. When Secret is set the cookie is HMAC-signed and cookies with a
+// bad signature are ignored. Requests whose pinned server is missing or
+// unhealthy fall back to the configured algorithm and are re-pinned.
+type StickyConfig struct {
+	Enabled    bool
+	CookieName string
+	Secret     []byte
+	TTL        time.Duration
+	Secure     bool
+}
+
+func (lb *LoadBalancer) stickyServer(r *http.Request) *Server {
+	cookie, err := r.Cookie(lb.config.Sticky.CookieName)
+	if err != nil {
+		return nil
+	}
+
+	id, ok := lb.decodeStickyCookie(cookie.Value)
+	if !ok {
+		return nil
+	}
+
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	server := lb.serverByID(id)
+	if server == nil || !server.available() {
+		return nil
+	}
+	return server
+}
+
+// setStickyCookie adds a cookie pinning the client to server to the response
+// header, unless r already carries it.
+func (lb *LoadBalancer) setStickyCookie(header http.Header, r *http.Request, server *Server) {
+	value := lb.encodeStickyCookie(server.ID)
+	if cookie, err := r.Cookie(lb.config.Sticky.CookieName); err == nil && cookie.Value == value {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     lb.config.Sticky.CookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   lb.config.Sticky.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ttl := lb.config.Sticky.TTL; ttl > 0 {
+		cookie.MaxAge = int(ttl / time.Second)
+	}
+	header.Add("Set-Cookie", cookie.String())
+}
+
+func (lb *LoadBalancer) encodeStickyCookie(serverID string) string {
+	value := base64.RawURLEncoding.EncodeToString([]byte(serverID))
+	if len(lb.config.Sticky.Secret) == 0 {
+		return value
+	}
+	return value + "." + lb.signSticky(value)
+}
+
+func (lb *LoadBalancer) decodeStickyCookie(value string) (string, bool) {
+	if len(lb.config.Sticky.Secret) > 0 {
+		payload, signature, found := strings.Cut(value, ".")
+		if !found || !hmac.Equal([]byte(signature), []byte(lb.signSticky(payload))) {
+			return "", false
+		}
+		value = payload
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", false
+	}
+	return string(id), true
+}
+
+func (lb *LoadBalancer) signSticky(payload string) string {
+	mac := hmac.New(sha256.New, lb.config.Sticky.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
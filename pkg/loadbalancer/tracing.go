@@ -0,0 +1,220 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const traceparentHeader = "Traceparent"
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// TracingConfig enables W3C trace context propagation and exports spans to
+// an OTLP/HTTP collector, e.g. http://localhost:4318/v1/traces. Requests
+// without a sampled parent are sampled at SampleRatio.
+type TracingConfig struct {
+	Enabled       bool
+	Endpoint      string
+	ServiceName   string
+	SampleRatio   float64
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(value string) (TraceContext, bool) {
+	var tc TraceContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 || isZero(traceID) {
+		return tc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 || isZero(spanID) {
+		return tc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return tc, false
+	}
+
+	copy(tc.TraceID[:], traceID)
+	copy(tc.SpanID[:], spanID)
+	tc.Sampled = flags[0]&0x01 == 1
+	return tc, true
+}
+
+func (tc TraceContext) Traceparent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(tc.TraceID[:]) + "-" + hex.EncodeToString(tc.SpanID[:]) + "-" + flags
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     SpanKind
+	context  TraceContext
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	errMsg   string
+	mutex    sync.Mutex
+}
+
+// SetAttribute records a string, bool, int or float attribute. It is a no-op
+// on a nil or unsampled span.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil || !s.context.Sampled {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errMsg = err.Error()
+}
+
+func (s *Span) End() {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.mutex.Lock()
+	s.end = time.Now()
+	s.mutex.Unlock()
+	s.tracer.exporter.export(s)
+}
+
+// Context returns the span's trace context, for propagation to backends.
+func (s *Span) Context() TraceContext {
+	return s.context
+}
+
+type spanKey struct{}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type Tracer struct {
+	config   TracingConfig
+	exporter *otlpExporter
+}
+
+func NewTracer(config TracingConfig, logger *slog.Logger) *Tracer {
+	if config.ServiceName == "" {
+		config.ServiceName = "loadbalancer"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "http://localhost:4318/v1/traces"
+	}
+	if config.SampleRatio == 0 {
+		config.SampleRatio = 1
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 512
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = 5 * time.Second
+	}
+
+	return &Tracer{
+		config:   config,
+		exporter: newOTLPExporter(config, logger),
+	}
+}
+
+// Start begins a span that is a child of the span in ctx, if any. A nil
+// Tracer returns ctx unchanged and a nil span, whose methods are no-ops.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]any),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parentID = parent.context.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = mathrand.Float64() < t.config.SampleRatio
+	}
+	rand.Read(span.context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// StartFromRequest begins a server span continuing the traceparent on r.
+func (t *Tracer) StartFromRequest(r *http.Request, name string) (context.Context, *Span) {
+	ctx := r.Context()
+	if t == nil {
+		return ctx, nil
+	}
+
+	if remote, ok := ParseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		ctx = context.WithValue(ctx, spanKey{}, &Span{context: remote})
+	}
+	return t.Start(ctx, name, SpanKindServer)
+}
+
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.shutdown(ctx)
+}
@@ -2,6 +2,7 @@ package loadbalancer
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,6 +13,18 @@ type Server struct {
 	Latency   int64
 	IsHealthy bool
 	LastProbe time.Time
+	Weight    int
+	State     ServerState
+	Zone      string
+	Labels    map[string]string
+
+	classRIF [criticalityClasses]int32
+	source   string
+	// adminState is set, under lb.mutex, when State was last set by
+	// SetServerState or DrainServer, so SetServers leaves it alone.
+	adminState bool
+	// removed is set, under lb.mutex, once the server leaves the pool.
+	removed bool
 }
 
 type ProbeResult struct {
@@ -19,13 +32,16 @@ type ProbeResult struct {
 	RIF       int32
 	Latency   int64
 	IsHealthy bool
+	Error     string
+
+	uses atomic.Int64
 }
 
 type Algorithm string
 
 const (
-	AlgorithmPrequal     Algorithm = "prequal"
-	AlgorithmRoundRobin  Algorithm = "roundrobin"
+	AlgorithmPrequal    Algorithm = "prequal"
+	AlgorithmRoundRobin Algorithm = "roundrobin"
 )
 
 type Config struct {
@@ -35,12 +51,39 @@ type Config struct {
 	SelectionChoices int
 	Algorithm        Algorithm
 	QRIF             float64
+	Admission        AdmissionConfig
+	ConcurrencyLimit ConcurrencyLimitConfig
+	Criticality      CriticalityConfig
+	Timeouts         TimeoutConfig
+	Retry            RetryConfig
+	Sticky           StickyConfig
+	Headers          HeaderConfig
+	RequestIDHeader  string
+	Tracing          TracingConfig
+	AccessLog        AccessLogConfig
+	Debug            DebugConfig
+	Metrics          MetricsConfig
 }
 
+// Stats counts the requests handled by a LoadBalancer. Every request is
+// counted in TotalRequests and then in exactly one of SuccessfulRequests or
+// FailedRequests. A request fails when the load balancer answers it with its
+// own error: rejected, shed, no server available, or no backend response.
+// Everything is updated with atomics, so recording never takes a lock.
 type Stats struct {
 	TotalRequests      uint64
 	SuccessfulRequests uint64
 	FailedRequests     uint64
-	AverageLatency     float64
-	mutex              sync.RWMutex
+	// AverageLatency is the average proxied request latency in seconds, as of
+	// the last call to LoadBalancer.Stats.
+	//
+	// Deprecated: use StatsSnapshot.AverageLatency from LoadBalancer.Stats.
+	AverageLatency float64
+
+	averageMutex sync.Mutex
+	latencySum   atomic.Int64
+	latencyCount atomic.Uint64
+	window       rollingWindow
+	// servers maps server IDs to *serverStats.
+	servers sync.Map
 }
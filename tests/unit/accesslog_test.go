@@ -0,0 +1,199 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestAccessLogJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		AccessLog: loadbalancer.AccessLogConfig{
+			Enabled: true,
+			Output:  path,
+		},
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{
+		ID:        "backend-1",
+		Address:   strings.TrimPrefix(backend.URL, "http://"),
+		IsHealthy: true,
+	})
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://lb.local/items?id=1", nil))
+	lb.Shutdown(context.Background())
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading access log: %v", err)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Access log line is not JSON: %v: %s", err, data)
+	}
+
+	expected := map[string]any{
+		"method":    "POST",
+		"path":      "/items?id=1",
+		"status":    float64(http.StatusCreated),
+		"bytes":     float64(5),
+		"server_id": "backend-1",
+		"retries":   float64(0),
+	}
+	for key, want := range expected {
+		if entry[key] != want {
+			t.Errorf("Access log %s = %v, expected %v", key, entry[key], want)
+		}
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	accessLog, err := loadbalancer.NewAccessLogger(loadbalancer.AccessLogConfig{
+		Format:     loadbalancer.AccessLogCombined,
+		Output:     path,
+		MaxSize:    200,
+		MaxBackups: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewAccessLogger: %v", err)
+	}
+	defer accessLog.Close()
+
+	for i := 0; i < 10; i++ {
+		accessLog.Log(&loadbalancer.AccessLogEntry{Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 200})
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("Expected 2 rotated backups, got %d", len(backups))
+	}
+}
+
+func TestAccessLogRotationKeepsUnrelatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	unrelated := []string{path + ".gz", path + ".bak", path + ".1"}
+	for _, name := range unrelated {
+		os.WriteFile(name, []byte("not a backup\n"), 0o644)
+	}
+
+	accessLog, err := loadbalancer.NewAccessLogger(loadbalancer.AccessLogConfig{
+		Format:     loadbalancer.AccessLogCombined,
+		Output:     path,
+		MaxSize:    200,
+		MaxBackups: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewAccessLogger: %v", err)
+	}
+	defer accessLog.Close()
+
+	for i := 0; i < 10; i++ {
+		accessLog.Log(&loadbalancer.AccessLogEntry{Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 200})
+	}
+
+	for _, name := range unrelated {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to survive pruning, got %v", filepath.Base(name), err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".2*")
+	if len(backups) != 1 {
+		t.Errorf("Expected 1 rotated backup, got %v", backups)
+	}
+}
+
+func TestAccessLogRotationFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	os.Mkdir(dir, 0o755)
+	path := filepath.Join(dir, "access.log")
+
+	accessLog, err := loadbalancer.NewAccessLogger(loadbalancer.AccessLogConfig{
+		Format:  loadbalancer.AccessLogCombined,
+		Output:  path,
+		MaxSize: 100,
+	})
+	if err != nil {
+		t.Fatalf("NewAccessLogger: %v", err)
+	}
+	defer accessLog.Close()
+	entry := &loadbalancer.AccessLogEntry{Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 200}
+	accessLog.Log(entry)
+
+	// With the directory gone the rotation and the reopen both fail.
+	os.RemoveAll(dir)
+	accessLog.Log(entry)
+
+	os.Mkdir(dir, 0o755)
+	accessLog.Log(&loadbalancer.AccessLogEntry{Method: "GET", Path: "/recovered", Proto: "HTTP/1.1", Status: 200})
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "/recovered") {
+		t.Errorf("Expected logging to resume once the path is writable again, got %q", data)
+	}
+}
+
+func TestAccessLogMaxAgeFromLastRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	os.WriteFile(path, []byte("old entry\n"), 0o644)
+	rotated := time.Now().Add(-2 * time.Hour).Format("20060102T150405.000000000")
+	os.WriteFile(path+"."+rotated, []byte("older entry\n"), 0o644)
+
+	accessLog, err := loadbalancer.NewAccessLogger(loadbalancer.AccessLogConfig{
+		Format: loadbalancer.AccessLogCombined,
+		Output: path,
+		MaxAge: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewAccessLogger: %v", err)
+	}
+	accessLog.Log(&loadbalancer.AccessLogEntry{Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 200})
+	accessLog.Close()
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("Expected a file started 2h ago to be rotated on the first write, got backups %v", backups)
+	}
+}
+
+func TestAccessLogOnlySlowOrFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := loadbalancer.NewAccessLogger(loadbalancer.AccessLogConfig{
+		Format:           loadbalancer.AccessLogLogfmt,
+		Output:           path,
+		OnlySlowOrFailed: true,
+	})
+	if err != nil {
+		t.Fatalf("NewAccessLogger: %v", err)
+	}
+
+	accessLog.Log(&loadbalancer.AccessLogEntry{Method: "GET", Path: "/ok", Status: 200})
+	accessLog.Log(&loadbalancer.AccessLogEntry{Method: "GET", Path: "/fail", Status: 502})
+	accessLog.Close()
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "/ok") || !strings.Contains(string(data), "path=/fail") {
+		t.Errorf("Expected only the failed request to be logged, got %q", data)
+	}
+}
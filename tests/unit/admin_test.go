@@ -0,0 +1,165 @@
+package unit
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestAdminAPI(t *testing.T) {
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	admin := lb.AdminHandler()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/servers", `{"id": "a", "address": "localhost:8081"}`, http.StatusCreated},
+		{"POST", "/servers", `{"id": "b", "address": "localhost:8082", "weight": 3}`, http.StatusCreated},
+		{"POST", "/servers", `{"id": "c", "address": "localhost:8083", "weight": 0}`, http.StatusBadRequest},
+		{"POST", "/servers", `{"id": "c", "address": "localhost:8083", "weight": -1}`, http.StatusBadRequest},
+		{"POST", "/servers", `{"id": "a", "address": "localhost:8083"}`, http.StatusConflict},
+		{"POST", "/servers", `{"id": "c", "address": "no-port"}`, http.StatusBadRequest},
+		{"POST", "/servers", `{"id": "c", "addr": "localhost:8083"}`, http.StatusBadRequest},
+		{"PUT", "/servers/a/weight", `{"weight": 2}`, http.StatusOK},
+		{"PUT", "/servers/a/weight", `{"weight": 0}`, http.StatusBadRequest},
+		{"PUT", "/servers/missing/weight", `{"weight": 2}`, http.StatusNotFound},
+		{"PUT", "/servers/b/state", `{"state": "disabled"}`, http.StatusOK},
+		{"PUT", "/servers/b/state", `{"state": "paused"}`, http.StatusBadRequest},
+		{"PUT", "/algorithm", `{"algorithm": "roundrobin"}`, http.StatusOK},
+		{"PUT", "/algorithm", `{"algorithm": "random"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := adminRequest(t, admin, tt.method, tt.path, tt.body); rec.Code != tt.status {
+			t.Errorf("%s %s %s: expected %d, got %d: %s", tt.method, tt.path, tt.body, tt.status, rec.Code, rec.Body)
+		}
+	}
+
+	var servers []loadbalancer.ServerInfo
+	rec := adminRequest(t, admin, "GET", "/servers", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &servers); err != nil {
+		t.Fatalf("Failed to decode servers: %v", err)
+	}
+	if len(servers) != 2 || servers[0].Weight != 2 || servers[1].State != loadbalancer.ServerDisabled {
+		t.Errorf("Unexpected servers: %+v", servers)
+	}
+	if lb.Algorithm() != loadbalancer.AlgorithmRoundRobin {
+		t.Errorf("Expected roundrobin, got %s", lb.Algorithm())
+	}
+
+	for i := 0; i < 10; i++ {
+		if server := lb.SelectServer(); server == nil || server.ID != "a" {
+			t.Fatalf("Expected only a to be selected while b is disabled, got %v", server)
+		}
+	}
+
+	if rec := adminRequest(t, admin, "DELETE", "/servers/a", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 removing a, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, admin, "DELETE", "/servers/a", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 removing a twice, got %d", rec.Code)
+	}
+	if server := lb.SelectServer(); server != nil {
+		t.Errorf("Expected no server with a removed and b disabled, got %s", server.ID)
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "a", Address: "localhost:8081", Weight: 1, IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "b", Address: "localhost:8082", Weight: 3, IsHealthy: true})
+
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[lb.SelectServer().ID]++
+	}
+	if counts["a"] != 10 || counts["b"] != 30 {
+		t.Errorf("Expected a 1:3 split, got %v", counts)
+	}
+}
+
+func TestAdminChangesUnderTraffic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "stable", Address: address, IsHealthy: true})
+	admin := lb.AdminHandler()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rec := httptest.NewRecorder()
+				lb.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local/", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("Expected 200 during admin changes, got %d", rec.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		adminRequest(t, admin, "POST", "/servers", `{"id": "extra", "address": "`+address+`"}`)
+		adminRequest(t, admin, "PUT", "/servers/extra/weight", `{"weight": 5}`)
+		adminRequest(t, admin, "PUT", "/algorithm", `{"algorithm": "roundrobin"}`)
+		adminRequest(t, admin, "PUT", "/servers/extra/state", `{"state": "draining"}`)
+		adminRequest(t, admin, "DELETE", "/servers/extra", "")
+		adminRequest(t, admin, "PUT", "/algorithm", `{"algorithm": "prequal"}`)
+	}
+	wg.Wait()
+}
+
+func TestSubscribeDecisions(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "only", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+
+	decisions, unsubscribe := lb.SubscribeDecisions(1)
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local/", nil))
+
+	decision := <-decisions
+	if decision.Winner != "only" || len(decision.Candidates) != 2 || decision.RequestID == "" {
+		t.Errorf("Unexpected decision: %+v", decision)
+	}
+	if got := rec.Header().Get("X-LB-Decision"); got != "" {
+		t.Errorf("Expected no decision header for a tailed request, got %q", got)
+	}
+
+	unsubscribe()
+	if _, ok := <-decisions; ok {
+		t.Error("Expected the channel to be closed after unsubscribing")
+	}
+}
@@ -0,0 +1,139 @@
+package unit
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestAdmissionShedsOverMaxRIF(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Admission:        loadbalancer.AdmissionConfig{Enabled: true, MaxRIF: 1, RetryAfter: 3 * time.Second},
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "slow", Address: strings.TrimPrefix(slow.URL, "http://"), IsHealthy: true})
+
+	done := make(chan int, 2)
+	serve := func(priority string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://lb.local/", nil)
+		if priority != "" {
+			req.Header.Set("X-Priority", priority)
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec
+	}
+	go func() { done <- serve("").Code }()
+	waitForRIF(t, lb, "slow", 1)
+
+	rec := serve("")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a request over MaxRIF to be shed with 503, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "3" {
+		t.Errorf("Expected Retry-After: 3, got %q", got)
+	}
+
+	// High priority requests may go up to 1.5 times MaxRIF.
+	go func() { done <- serve("high").Code }()
+	waitForRIF(t, lb, "slow", 2)
+	close(release)
+	for range 2 {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected admitted requests to succeed, got %d", code)
+		}
+	}
+}
+
+func TestAdmissionShedsOverMaxLatency(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Admission:        loadbalancer.AdmissionConfig{Enabled: true, MaxLatency: 100 * time.Millisecond},
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{
+		ID:        "backend",
+		Address:   strings.TrimPrefix(backend.URL, "http://"),
+		Latency:   120,
+		IsHealthy: true,
+	})
+
+	for _, tc := range []struct {
+		priority string
+		code     int
+	}{
+		{"low", http.StatusServiceUnavailable},
+		{"normal", http.StatusServiceUnavailable},
+		{"high", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "http://lb.local/", nil)
+		req.Header.Set("X-Priority", tc.priority)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("Expected %d for %s priority at 120ms, got %d", tc.code, tc.priority, rec.Code)
+		}
+		if tc.code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("Expected the default Retry-After of 1s, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+
+	if loadbalancer.ParsePriority("low").Criticality() != loadbalancer.CriticalitySheddable {
+		t.Error("Expected low priority to be sheddable")
+	}
+}
+
+func TestAdmissionPriorityHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Admission: loadbalancer.AdmissionConfig{
+			Enabled:         true,
+			MaxLatency:      100 * time.Millisecond,
+			PriorityHeader:  "X-Importance",
+			PriorityFactors: map[loadbalancer.Priority]float64{loadbalancer.PriorityNormal: 2},
+		},
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "backend", Address: strings.TrimPrefix(backend.URL, "http://"), Latency: 120, IsHealthy: true})
+
+	serve := func(header, priority string) int {
+		req := httptest.NewRequest("GET", "http://lb.local/", nil)
+		req.Header.Set(header, priority)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := serve("X-Importance", "low"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected low priority in the configured header to be shed, got %d", code)
+	}
+	// The X-Priority header is not looked at, and normal priority may go up
+	// to twice MaxLatency.
+	if code := serve("X-Priority", "low"); code != http.StatusOK {
+		t.Errorf("Expected the default header to be ignored, got %d", code)
+	}
+
+	if loadbalancer.PriorityLow != 0 || loadbalancer.PriorityNormal != 1 || loadbalancer.PriorityHigh != 2 {
+		t.Error("Expected the priority values to stay low 0, normal 1 and high 2")
+	}
+	if loadbalancer.PriorityHigh.String() != "high" {
+		t.Errorf("Expected high priority to print as high, got %s", loadbalancer.PriorityHigh)
+	}
+}
@@ -2,6 +2,9 @@ package unit
 
 import (
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -38,3 +41,34 @@ func TestLoadBalancer(t *testing.T) {
 		t.Error("Expected server to be selected, got nil")
 	}
 }
+
+func TestSelectionDecisionHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Debug:            loadbalancer.DebugConfig{Enabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{
+		ID:        "only",
+		Address:   strings.TrimPrefix(backend.URL, "http://"),
+		IsHealthy: true,
+	})
+
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local/", nil))
+	if got := rec.Header().Get("X-LB-Decision"); got != "" {
+		t.Errorf("Expected no decision header without X-LB-Debug, got %q", got)
+	}
+
+	req := httptest.NewRequest("GET", "http://lb.local/", nil)
+	req.Header.Set("X-LB-Debug", "true")
+	rec = httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+
+	expected := "algorithm=prequal threshold=0 candidates=only:rif=0,lat=0s,cold;only:rif=0,lat=0s,cold winner=only"
+	if got := rec.Header().Get("X-LB-Decision"); got != expected {
+		t.Errorf("Expected decision %q, got %q", expected, got)
+	}
+}
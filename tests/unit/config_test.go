@@ -0,0 +1,285 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/internal/config"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "config.json", `{
+		"port": "8090",
+		"algorithm": "roundrobin",
+		"qrif": 0.5,
+		"pools": [
+			{"name": "a", "servers": [{"id": "a1", "address": "localhost:8081"}]},
+			{"name": "b", "algorithm": "prequal", "servers": [{"id": "b1", "address": "localhost:8082"}]}
+		]
+	}`)
+
+	cfg, err := config.ReadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	env := map[string]string{
+		"LB_QRIF":           "0.9",
+		"LB_PROBE_INTERVAL": "500ms",
+		"LB_SERVERS":        "s1=localhost:9001, localhost:9002",
+	}
+	if err := cfg.ApplyEnv(func(key string) string { return env[key] }); err != nil {
+		t.Fatalf("Failed to apply env: %v", err)
+	}
+	cfg.SetDefaults()
+
+	if cfg.Port != "8090" || cfg.QRIF != 0.9 || cfg.ProbeInterval != config.Duration(500*time.Millisecond) || cfg.ProbeTimeout != cfg.ProbeInterval {
+		t.Errorf("Unexpected top-level settings: %+v", cfg)
+	}
+	if a, b := cfg.Pools[0], cfg.Pools[1]; a.Algorithm != "roundrobin" || a.QRIF != 0.9 || b.Algorithm != "prequal" || b.ProbeInterval != cfg.ProbeInterval {
+		t.Errorf("Expected pools to inherit unset settings, got %+v and %+v", a, b)
+	}
+	if len(cfg.Servers) != 2 || cfg.Servers[0].ID != "s1" || cfg.Servers[1].ID != "localhost:9002" {
+		t.Errorf("Unexpected servers from LB_SERVERS: %+v", cfg.Servers)
+	}
+
+	bad := map[string]string{"LB_QRIF": "high", "LB_PROBE_TIMEOUT": "2"}
+	if err := cfg.ApplyEnv(func(key string) string { return bad[key] }); err == nil {
+		t.Error("Expected invalid environment values to be rejected")
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"probe_interval": "2s", "probe_timeout": 500000000, "servers": [{"id": "a", "address": "localhost:8081"}]}`,
+		"config.yaml": "probe_interval: 2s\nprobe_timeout: 500ms\nservers:\n  - id: a\n    address: localhost:8081\n",
+		"config.toml": "probe_interval = \"2s\"\nprobe_timeout = \"500ms\"\n[[servers]]\nid = \"a\"\naddress = \"localhost:8081\"\n",
+	}
+	for name, data := range files {
+		cfg, err := config.LoadConfig(writeConfig(t, name, data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if time.Duration(cfg.ProbeInterval) != 2*time.Second || time.Duration(cfg.ProbeTimeout) != 500*time.Millisecond || len(cfg.Servers) != 1 {
+			t.Errorf("%s: unexpected config %+v", name, cfg)
+		}
+	}
+
+	unknown := map[string]string{
+		"config.json": `{"probe_intervl": "2s"}`,
+		"config.yaml": "servers:\n  - id: a\n    addr: localhost:8081\n",
+		"config.toml": "port = \"8080\"\nalgorithim = \"prequal\"\n",
+	}
+	for name, data := range unknown {
+		if _, err := config.ReadConfig(writeConfig(t, name, data)); err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("%s: expected an unknown field error, got %v", name, err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := &config.Config{
+		QRIF:             1.5,
+		SelectionChoices: -1,
+		ProbeInterval:    config.Duration(time.Second),
+		ProbeTimeout:     config.Duration(2 * time.Second),
+		Pools: []config.PoolConfig{{
+			Name: "api",
+			Servers: []config.ServerConfig{
+				{ID: "a", Address: "localhost:8081"},
+				{ID: "a", Address: "localhost"},
+				{ID: "api", Address: "api.internal:8080", Resolve: "dns"},
+				{ID: "web", Address: "_http._tcp.web.internal", Resolve: "mdns"},
+			},
+			Discovery: []config.DiscoveryConfig{
+				{Type: "file", Path: "endpoints.json"},
+				{Type: "http", URL: "catalog.internal/endpoints"},
+			},
+		}},
+		Routes: []config.RouteConfig{{Name: "web", Pool: "web"}},
+		PolicyConfig: config.PolicyConfig{
+			Admission: &config.AdmissionConfig{Enabled: true, MaxRIF: -1, CriticalityFactors: map[string]float64{"batch": 0.5}},
+			ConcurrencyLimit: &config.ConcurrencyLimitConfig{
+				Algorithm: "vegas",
+				MinLimit:  10,
+				MaxLimit:  5,
+				Backoff:   1.5,
+			},
+			Criticality: &config.CriticalityConfig{
+				Default: "urgent",
+				Routes:  []config.CriticalityRouteConfig{{PathRegex: "(", Criticality: "critical"}},
+			},
+			Timeouts: &config.TimeoutConfig{Routes: []config.TimeoutRouteConfig{{PathPrefix: "/slow"}}},
+			Retry:    &config.RetryConfig{MaxRetries: -1},
+			Sticky:   &config.StickyConfig{Enabled: true, TTL: config.Duration(-time.Second)},
+			Headers: &config.HeaderConfig{
+				Request:        []config.HeaderRuleConfig{{Action: "append", Name: "X-LB"}},
+				TrustedProxies: []string{"10.0.0.0/8", "proxy.internal"},
+			},
+			Tracing:   &config.TracingConfig{Enabled: true, Endpoint: "collector:4318", SampleRatio: 2},
+			AccessLog: &config.AccessLogConfig{Enabled: true, Format: "xml", SampleRate: -0.5},
+		},
+	}
+	cfg.SetDefaults()
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, path := range []string{
+		"qrif", "selection_choices", "probe_timeout",
+		"pools[0].qrif", "pools[0].servers[1].id", "pools[0].servers[1].address", "pools[0].servers[3].resolve",
+		"pools[0].discovery[1].url", "routes[0].pool",
+		"admission.max_rif", "admission.criticality_factors.batch",
+		"concurrency_limit.algorithm", "concurrency_limit.min_limit", "concurrency_limit.backoff",
+		"criticality.default", "criticality.routes[0].path_regex", "timeouts.routes[0].timeout",
+		"retry.max_retries", "sticky.ttl", "headers.request[0].action", "headers.trusted_proxies[1]",
+		"tracing.endpoint", "tracing.sample_ratio", "access_log.format", "access_log.sample_rate",
+	} {
+		if !strings.Contains(err.Error(), path+":") {
+			t.Errorf("Expected an error for %s, got:\n%v", path, err)
+		}
+	}
+
+	// Sections the pool takes from the top level are reported once.
+	if strings.Contains(err.Error(), "pools[0].admission") {
+		t.Errorf("Expected inherited sections to be checked only at the top level, got:\n%v", err)
+	}
+
+	routes := &config.Config{
+		Pools: []config.PoolConfig{{Name: "api"}},
+		Routes: []config.RouteConfig{
+			{Name: "none"},
+			{Name: "regex", Pool: "api", PathRegex: "("},
+			{Name: "split", Splits: []config.SplitConfig{{Pool: "api", Weight: -1}}},
+			{Name: "mirror", Pool: "api", Mirror: &config.MirrorConfig{Pool: "shadow", Percent: 150}},
+		},
+	}
+	routes.SetDefaults()
+	err = routes.Validate()
+	for _, path := range []string{
+		"routes[0].pool", "routes[1].path_regex", "routes[2].splits[0].weight", "routes[2].splits",
+		"routes[3].mirror.pool", "routes[3].mirror.percent",
+	} {
+		if err == nil || !strings.Contains(err.Error(), path+":") {
+			t.Errorf("Expected an error for %s, got:\n%v", path, err)
+		}
+	}
+
+	// Routes are checked even without pools, where they have nothing to route to.
+	noPools := &config.Config{
+		Servers: []config.ServerConfig{{ID: "a", Address: "localhost:8081"}},
+		Routes:  []config.RouteConfig{{Name: "api", PathPrefix: "/api", Pool: "api"}},
+	}
+	noPools.SetDefaults()
+	err = noPools.Validate()
+	for _, path := range []string{"routes", "routes[0].pool"} {
+		if err == nil || !strings.Contains(err.Error(), path+":") {
+			t.Errorf("Expected an error for %s without pools, got:\n%v", path, err)
+		}
+	}
+
+	valid := &config.Config{Servers: []config.ServerConfig{{ID: "a", Address: "localhost:8081"}}}
+	valid.SetDefaults()
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+	if valid.ProbeTimeout != valid.ProbeInterval {
+		t.Errorf("Expected the probe timeout to be capped at the 1s probe interval, got %s", valid.ProbeTimeout)
+	}
+}
+
+func TestConfigProbeTimeoutDefault(t *testing.T) {
+	cfg := &config.Config{
+		ProbeInterval: config.Duration(5 * time.Second),
+		Pools: []config.PoolConfig{
+			{Name: "fast", ProbeInterval: config.Duration(500 * time.Millisecond)},
+			{Name: "slow"},
+		},
+	}
+	cfg.SetDefaults()
+	if cfg.ProbeTimeout != config.Duration(2*time.Second) {
+		t.Errorf("Expected a 2s probe timeout with a 5s interval, got %s", cfg.ProbeTimeout)
+	}
+	if cfg.Pools[0].ProbeTimeout != config.Duration(500*time.Millisecond) {
+		t.Errorf("Expected the fast pool's timeout to be capped at its 500ms interval, got %s", cfg.Pools[0].ProbeTimeout)
+	}
+	if cfg.Pools[1].ProbeTimeout != config.Duration(2*time.Second) {
+		t.Errorf("Expected the slow pool to inherit the 2s timeout, got %s", cfg.Pools[1].ProbeTimeout)
+	}
+
+	defaults := &config.Config{}
+	defaults.SetDefaults()
+	if defaults.ProbeTimeout != config.Duration(time.Second) {
+		t.Errorf("Expected a 1s probe timeout with the default 1s interval, got %s", defaults.ProbeTimeout)
+	}
+}
+
+func TestConfigPolicy(t *testing.T) {
+	cfg, err := config.LoadConfig(writeConfig(t, "config.yaml", `
+probe_interval: 5s
+admission:
+  enabled: true
+  max_rif: 50
+  criticality_factors:
+    sheddable: 0.25
+sticky:
+  enabled: true
+  secret: s3cret
+  ttl: 1h
+access_log:
+  enabled: true
+  output: stdout
+pools:
+  - name: api
+    servers: [{id: a, address: "localhost:8081"}]
+    admission:
+      enabled: false
+  - name: web
+    servers: [{id: w, address: "localhost:8082"}]
+routes:
+  - {name: api, path_prefix: /api, pool: api}
+  - {name: web, pool: web}
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.ProbeTimeout != config.Duration(2*time.Second) {
+		t.Errorf("Expected a 2s probe timeout with a 5s interval, got %s", cfg.ProbeTimeout)
+	}
+
+	api, web := cfg.Pools[0], cfg.Pools[1]
+	if api.Admission.Enabled || !web.Admission.Enabled || web.Admission.MaxRIF != 50 {
+		t.Errorf("Expected api to override admission and web to inherit it, got %+v and %+v", api.Admission, web.Admission)
+	}
+	if api.Sticky == nil || web.Sticky == nil || time.Duration(web.Sticky.TTL) != time.Hour {
+		t.Errorf("Expected both pools to inherit sticky sessions, got %+v and %+v", api.Sticky, web.Sticky)
+	}
+	if api.Retry != nil {
+		t.Errorf("Expected retries to stay off, got %+v", api.Retry)
+	}
+
+	shared := writeConfig(t, "shared.yaml", `
+access_log: {enabled: true, output: /var/log/lb/access.log}
+pools:
+  - {name: api, servers: [{id: a, address: "localhost:8081"}]}
+  - {name: web, servers: [{id: w, address: "localhost:8082"}]}
+routes:
+  - {name: web, pool: web}
+`)
+	if _, err := config.LoadConfig(shared); err == nil || !strings.Contains(err.Error(), "pools[1].access_log.output:") {
+		t.Errorf("Expected pools sharing an access log file to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package unit
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestCriticalityShedsInOrder(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Admission:        loadbalancer.AdmissionConfig{Enabled: true, MaxRIF: 2},
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	server := &loadbalancer.Server{ID: "slow", Address: strings.TrimPrefix(slow.URL, "http://"), IsHealthy: true}
+	lb.AddServer(server)
+
+	done := make(chan int, 3)
+	serve := func(criticality string) int {
+		req := httptest.NewRequest("GET", "http://lb.local/", nil)
+		req.Header.Set("X-Criticality", criticality)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	admit := func(criticality string, rif int32) {
+		t.Helper()
+		go func() { done <- serve(criticality) }()
+		waitForRIF(t, lb, "slow", rif)
+	}
+
+	// With MaxRIF 2 the limits are 1 for sheddable, 2 for default and 3 for
+	// critical requests.
+	admit("default", 1)
+	if code := serve("sheddable"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected sheddable to be shed first, got %d", code)
+	}
+	admit("default", 2)
+	if code := serve("default"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected default to be shed at MaxRIF, got %d", code)
+	}
+	admit("critical", 3)
+
+	if got := server.ClassRIF(loadbalancer.CriticalityDefault); got != 2 {
+		t.Errorf("Expected 2 default requests in flight, got %d", got)
+	}
+	if got := server.ClassRIF(loadbalancer.CriticalityCritical); got != 1 {
+		t.Errorf("Expected 1 critical request in flight, got %d", got)
+	}
+	if got := server.ClassRIF(loadbalancer.CriticalitySheddable); got != 0 {
+		t.Errorf("Expected no sheddable requests in flight, got %d", got)
+	}
+
+	close(release)
+	for range 3 {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected admitted requests to succeed, got %d", code)
+		}
+	}
+	waitForRIF(t, lb, "slow", 0)
+	if got := server.ClassRIF(loadbalancer.CriticalityDefault); got != 0 {
+		t.Errorf("Expected the class RIF to drop back to 0, got %d", got)
+	}
+}
+
+func TestSheddableRequestsAreNotRetried(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+	bad := httptest.NewServer(nil)
+	bad.Close()
+
+	serve := func(criticality string) int {
+		lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+			Algorithm: loadbalancer.AlgorithmRoundRobin,
+			Retry:     loadbalancer.RetryConfig{MaxRetries: 1},
+			Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+		}, slog.Default())
+		lb.AddServer(&loadbalancer.Server{ID: "bad", Address: strings.TrimPrefix(bad.URL, "http://"), IsHealthy: true})
+		lb.AddServer(&loadbalancer.Server{ID: "good", Address: strings.TrimPrefix(good.URL, "http://"), IsHealthy: true})
+
+		req := httptest.NewRequest("GET", "http://lb.local/", nil)
+		req.Header.Set("X-Criticality", criticality)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve("default"); code != http.StatusOK {
+		t.Errorf("Expected a default request to be retried on the good server, got %d", code)
+	}
+	if code := serve("sheddable"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a sheddable request not to be retried, got %d", code)
+	}
+}
+
+func TestConcurrencyLimiterQueuesByCriticality(t *testing.T) {
+	limiter := loadbalancer.NewConcurrencyLimiter(loadbalancer.ConcurrencyLimitConfig{
+		Algorithm:    loadbalancer.LimitAlgorithmAIMD,
+		InitialLimit: 1,
+		QueueTimeout: time.Second,
+	})
+	ctx := context.Background()
+
+	if !limiter.AcquireCriticality(ctx, loadbalancer.CriticalityDefault, 1) {
+		t.Fatal("Expected the first request to be admitted")
+	}
+	start := time.Now()
+	if limiter.AcquireCriticality(ctx, loadbalancer.CriticalitySheddable, 1) {
+		t.Error("Expected a sheddable request over the limit to be rejected")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Expected a sheddable request not to wait for a slot")
+	}
+
+	admitted := make(chan loadbalancer.Criticality, 2)
+	for _, c := range []loadbalancer.Criticality{loadbalancer.CriticalityDefault, loadbalancer.CriticalityCritical} {
+		go func() {
+			if limiter.AcquireCriticality(ctx, c, 1) {
+				admitted <- c
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	limiter.Cancel()
+	if c := <-admitted; c != loadbalancer.CriticalityCritical {
+		t.Errorf("Expected the critical request to get the freed slot first, got %s", c)
+	}
+	limiter.Cancel()
+	if c := <-admitted; c != loadbalancer.CriticalityDefault {
+		t.Errorf("Expected the default request to get the next slot, got %s", c)
+	}
+}
@@ -0,0 +1,178 @@
+package unit
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"250m", 250 * time.Millisecond, false},
+		{"2S", 2 * time.Second, false},
+		{"1H", time.Hour, false},
+		{"100u", 100 * time.Microsecond, false},
+		{"5", 0, true},
+		{"10x", 0, true},
+		{"123456789m", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := loadbalancer.ParseGRPCTimeout(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseGRPCTimeout(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseGRPCTimeout(%q) = %v, expected %v", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestParseDeadline(t *testing.T) {
+	want := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	got, err := loadbalancer.ParseDeadline(want.Format(time.RFC3339Nano))
+	if err != nil || !got.Equal(want) {
+		t.Errorf("Expected %v, got %v (err %v)", want, got, err)
+	}
+
+	got, err = loadbalancer.ParseDeadline("1893553445000")
+	if err != nil || !got.Equal(want) {
+		t.Errorf("Expected %v from unix millis, got %v (err %v)", want, got, err)
+	}
+}
+
+func TestExpiredDeadline(t *testing.T) {
+	reached := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "backend", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+
+	req := httptest.NewRequest("GET", "http://lb.local/", nil)
+	req.Header.Set("X-Request-Deadline", time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano))
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 for an expired deadline, got %d", rec.Code)
+	}
+	if reached {
+		t.Error("Expected a request past its deadline not to reach the backend")
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Timeouts: loadbalancer.TimeoutConfig{
+			Default: 500 * time.Millisecond,
+			Routes:  []loadbalancer.TimeoutRoute{{PathPrefix: "/fast", Timeout: 20 * time.Millisecond}},
+		},
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "slow", Address: strings.TrimPrefix(slow.URL, "http://"), IsHealthy: true})
+
+	for _, tc := range []struct {
+		path    string
+		timeout time.Duration
+	}{
+		{"/fast/report", 20 * time.Millisecond},
+		{"/other", 500 * time.Millisecond},
+	} {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local"+tc.path, nil))
+		elapsed := time.Since(start)
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("Expected 504 when %s times out, got %d", tc.path, rec.Code)
+		}
+		if elapsed < tc.timeout || elapsed > tc.timeout+400*time.Millisecond {
+			t.Errorf("Expected %s to time out after %s, took %s", tc.path, tc.timeout, elapsed)
+		}
+	}
+}
+
+func TestDeadlineHeadersForwarded(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Timeouts:         loadbalancer.TimeoutConfig{Default: 10 * time.Second},
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "backend", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+
+	// The client's grpc-timeout is shorter than the route timeout, so it
+	// sets the deadline.
+	req := httptest.NewRequest("GET", "http://lb.local/", nil)
+	req.Header.Set("Grpc-Timeout", "2S")
+	sent := time.Now()
+	lb.ServeHTTP(httptest.NewRecorder(), req)
+	received := <-headers
+
+	deadline, err := loadbalancer.ParseDeadline(received.Get("X-Request-Deadline"))
+	if err != nil {
+		t.Fatalf("Expected a deadline header, got %q: %v", received.Get("X-Request-Deadline"), err)
+	}
+	if remaining := deadline.Sub(sent); remaining > 2100*time.Millisecond || remaining < 1500*time.Millisecond {
+		t.Errorf("Expected the deadline about 2s out, got %s", remaining)
+	}
+	timeout, err := loadbalancer.ParseGRPCTimeout(received.Get("Grpc-Timeout"))
+	if err != nil || timeout >= 2*time.Second || timeout < 1500*time.Millisecond {
+		t.Errorf("Expected the remaining budget in grpc-timeout, got %q", received.Get("Grpc-Timeout"))
+	}
+	if req.Header.Get("Grpc-Timeout") != "2S" || req.Header.Get("X-Request-Deadline") != "" {
+		t.Errorf("Expected the inbound headers to be left alone, got %v", req.Header)
+	}
+}
+
+func TestRetrySkippedWithoutBudget(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+	bad := httptest.NewServer(nil)
+	bad.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Retry:     loadbalancer.RetryConfig{MaxRetries: 1},
+		Timeouts:  loadbalancer.TimeoutConfig{Default: 200 * time.Millisecond},
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "bad", Address: strings.TrimPrefix(bad.URL, "http://"), IsHealthy: true})
+	// good usually takes longer than the whole 200ms budget.
+	lb.AddServer(&loadbalancer.Server{ID: "good", Address: strings.TrimPrefix(good.URL, "http://"), Latency: 500, IsHealthy: true})
+
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the retry to be skipped for lack of budget, got %d", rec.Code)
+	}
+}
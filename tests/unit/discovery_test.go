@@ -0,0 +1,156 @@
+package unit
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func waitForServerIDs(t *testing.T, lb *loadbalancer.LoadBalancer, expected ...string) bool {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if slices.Equal(serverIDs(lb), expected) {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+- id: api-1
+  address: localhost:8081
+  weight: 2
+  zone: us-east-1a
+  labels: {version: v1}
+- address: localhost:8082
+`)
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "static", Address: "localhost:8080", IsHealthy: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	discovery := &loadbalancer.FileDiscovery{Path: path, Interval: 5 * time.Millisecond}
+	go lb.RunDiscovery(ctx, "file", discovery, 0)
+
+	if !waitForServerIDs(t, lb, "api-1", "localhost:8082", "static") {
+		t.Fatalf("Expected the file's endpoints to be added, got %v", serverIDs(lb))
+	}
+	for _, server := range lb.Servers() {
+		if server.ID == "api-1" && (server.Weight != 2 || server.Zone != "us-east-1a" || server.Labels["version"] != "v1") {
+			t.Errorf("Expected the endpoint's weight, zone and labels, got %+v", server)
+		}
+	}
+
+	write(`[{"id": "api-1", "address": "localhost:8081", "bogus": true}]`)
+	time.Sleep(50 * time.Millisecond)
+	if ids := serverIDs(lb); !slices.Equal(ids, []string{"api-1", "localhost:8082", "static"}) {
+		t.Errorf("Expected an invalid file to keep the last good servers, got %v", ids)
+	}
+
+	write(`- {id: api-2, address: localhost:8083}`)
+	if !waitForServerIDs(t, lb, "api-2", "static") {
+		t.Errorf("Expected the servers to follow the file, got %v", serverIDs(lb))
+	}
+}
+
+func TestHTTPDiscovery(t *testing.T) {
+	var mutex sync.Mutex
+	body, etag := `[{"id": "api-1", "address": "localhost:8081"}]`, `"1"`
+	var requests, notModified int
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer catalog.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	discovery := &loadbalancer.HTTPDiscovery{URL: catalog.URL, Interval: 5 * time.Millisecond}
+	go lb.RunDiscovery(ctx, "http", discovery, 0)
+
+	if !waitForServerIDs(t, lb, "api-1") {
+		t.Fatalf("Expected the catalog's endpoints to be added, got %v", serverIDs(lb))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		n := notModified
+		mutex.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mutex.Lock()
+	if notModified == 0 {
+		t.Errorf("Expected the ETag to be sent back, got %d requests without a 304", requests)
+	}
+	body, etag = `[{"id": "api-2", "address": "localhost:8082", "zone": "b"}]`, `"2"`
+	mutex.Unlock()
+
+	if !waitForServerIDs(t, lb, "api-2") {
+		t.Errorf("Expected the servers to follow the catalog, got %v", serverIDs(lb))
+	}
+}
+
+func TestHTTPDiscoveryIgnoredWait(t *testing.T) {
+	var requests atomic.Int32
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("wait") != "10s" {
+			t.Errorf("Expected ?wait=10s, got %q", r.URL.RawQuery)
+		}
+		// Answer at once instead of holding the request for the wait.
+		w.Write([]byte(`[{"id": "api-1", "address": "localhost:8081"}]`))
+	}))
+	defer catalog.Close()
+
+	discovery := &loadbalancer.HTTPDiscovery{URL: catalog.URL, Interval: 50 * time.Millisecond, Wait: 10 * time.Second}
+	if _, err := discovery.Next(context.Background()); err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if _, err := discovery.Next(ctx); err == nil {
+		t.Error("Expected Next to block until ctx is done while nothing changes")
+	}
+	if n := requests.Load(); n > 7 {
+		t.Errorf("Expected early responses to be followed by a pause of Interval, got %d requests in 250ms", n)
+	}
+}
@@ -0,0 +1,166 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+type fakeResolver struct {
+	mutex sync.Mutex
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+	ttl   time.Duration
+	err   error
+}
+
+func (r *fakeResolver) set(update func(r *fakeResolver)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	update(r)
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.hosts[host]...), r.ttl, r.err
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.srv[name], r.ttl, r.err
+}
+
+func serverIDs(lb *loadbalancer.LoadBalancer) []string {
+	var ids []string
+	for _, server := range lb.Servers() {
+		ids = append(ids, server.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "static", Address: "localhost:8081", IsHealthy: true})
+
+	resolver := &fakeResolver{
+		hosts: map[string][]string{"api.internal": {"10.0.0.2", "10.0.0.1"}},
+		srv: map[string][]*net.SRV{"_http._tcp.web.internal": {
+			{Target: "web-1.internal.", Port: 80, Priority: 10, Weight: 3},
+			{Target: "web-2.internal.", Port: 80, Priority: 10, Weight: 1},
+			{Target: "web-backup.internal.", Port: 80, Priority: 20},
+		}},
+	}
+	discovery := loadbalancer.NewDNSDiscovery(lb, []loadbalancer.DNSTarget{
+		{ID: "api", Name: "api.internal:8080"},
+		{ID: "web", Name: "_http._tcp.web.internal", SRV: true},
+	}, loadbalancer.DNSConfig{Resolver: resolver})
+
+	if err := discovery.Resolve(context.Background()); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	expected := []string{"api/10.0.0.1:8080", "api/10.0.0.2:8080", "static", "web/web-1.internal:80", "web/web-2.internal:80"}
+	if ids := serverIDs(lb); !slices.Equal(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+	for _, server := range lb.Servers() {
+		if server.ID == "web/web-1.internal:80" && server.Weight != 3 {
+			t.Errorf("Expected the SRV weight to be used, got %d", server.Weight)
+		}
+	}
+
+	resolver.set(func(r *fakeResolver) { r.err = errors.New("SERVFAIL") })
+	if err := discovery.Resolve(context.Background()); err == nil {
+		t.Error("Expected the lookup error to be returned")
+	}
+	if ids := serverIDs(lb); !slices.Equal(ids, expected) {
+		t.Errorf("Expected the last good servers to be kept, got %v", ids)
+	}
+
+	resolver.set(func(r *fakeResolver) {
+		r.err = nil
+		r.hosts["api.internal"] = []string{"10.0.0.2", "10.0.0.3"}
+	})
+	discovery.SetTargets([]loadbalancer.DNSTarget{{ID: "api", Name: "api.internal:8080"}})
+	if err := discovery.Resolve(context.Background()); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	expected = []string{"api/10.0.0.2:8080", "api/10.0.0.3:8080", "static"}
+	if ids := serverIDs(lb); !slices.Equal(ids, expected) {
+		t.Errorf("Expected %v after the records changed, got %v", expected, ids)
+	}
+}
+
+func TestDNSDiscoveryAfterDrain(t *testing.T) {
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	resolver := &fakeResolver{hosts: map[string][]string{"api.internal": {"10.0.0.1"}}}
+	discovery := loadbalancer.NewDNSDiscovery(lb, []loadbalancer.DNSTarget{{ID: "api", Name: "api.internal:8080"}},
+		loadbalancer.DNSConfig{Resolver: resolver})
+
+	if err := discovery.Resolve(context.Background()); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if _, err := lb.DrainServer(context.Background(), "api/10.0.0.1:8080"); err != nil {
+		t.Fatalf("DrainServer failed: %v", err)
+	}
+	if ids := serverIDs(lb); len(ids) != 0 {
+		t.Fatalf("Expected the drained server to be removed, got %v", ids)
+	}
+
+	// A failed lookup falls back to the servers of the last good one.
+	resolver.set(func(r *fakeResolver) { r.err = errors.New("SERVFAIL") })
+	discovery.Resolve(context.Background())
+	servers := lb.Servers()
+	if len(servers) != 1 || servers[0].State != loadbalancer.ServerActive {
+		t.Errorf("Expected the refresh to add the server back as active, got %+v", servers)
+	}
+}
+
+func TestDNSDiscoveryRespectsTTL(t *testing.T) {
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	resolver := &fakeResolver{
+		hosts: map[string][]string{"api.internal": {"10.0.0.1"}},
+		ttl:   20 * time.Millisecond,
+	}
+	discovery := loadbalancer.NewDNSDiscovery(lb, []loadbalancer.DNSTarget{{ID: "api", Name: "api.internal:8080"}},
+		loadbalancer.DNSConfig{Resolver: resolver, Refresh: time.Minute, MinRefresh: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go discovery.Run(ctx)
+
+	waitForServers := func(expected ...string) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if slices.Equal(serverIDs(lb), expected) {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+	if !waitForServers("api/10.0.0.1:8080") {
+		t.Fatalf("Expected the first lookup to add the server, got %v", serverIDs(lb))
+	}
+
+	resolver.set(func(r *fakeResolver) { r.hosts["api.internal"] = []string{"10.0.0.9"} })
+	if !waitForServers("api/10.0.0.9:8080") {
+		t.Errorf("Expected the record to be re-resolved after its TTL, got %v", serverIDs(lb))
+	}
+}
@@ -0,0 +1,191 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func waitForRIF(t *testing.T, lb *loadbalancer.LoadBalancer, id string, rif int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, server := range lb.Servers() {
+			if server.ID == id && server.RIF == rif {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s to reach RIF %d", id, rif)
+}
+
+func TestDrainServer(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "slow", Address: strings.TrimPrefix(slow.URL, "http://"), IsHealthy: true})
+
+	events := make(chan loadbalancer.DrainEvent, 1)
+	lb.OnDrain(func(event loadbalancer.DrainEvent) { events <- event })
+
+	inflight := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local/", nil))
+		inflight <- rec.Code
+	}()
+	waitForRIF(t, lb, "slow", 1)
+
+	lb.AddServer(&loadbalancer.Server{ID: "fast", Address: strings.TrimPrefix(fast.URL, "http://"), IsHealthy: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := lb.DrainServer(ctx, "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the drain to time out, got %v", err)
+	}
+	if event := <-events; event.Remaining != 1 || event.Err == nil {
+		t.Errorf("Expected a timed out event with 1 request remaining, got %+v", event)
+	}
+
+	for i := 0; i < 10; i++ {
+		if server := lb.SelectServer(); server == nil || server.ID != "fast" {
+			t.Fatalf("Expected only fast to be selected while slow drains, got %v", server)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := lb.DrainServer(context.Background(), "slow")
+		done <- err
+	}()
+
+	close(release)
+	if code := <-inflight; code != http.StatusOK {
+		t.Errorf("Expected the in-flight request to finish with 200, got %d", code)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the drain to complete, got %v", err)
+	}
+	if event := <-events; event.ServerID != "slow" || event.Err != nil {
+		t.Errorf("Expected a completed event for slow, got %+v", event)
+	}
+
+	servers := lb.Servers()
+	if len(servers) != 1 || servers[0].ID != "fast" {
+		t.Errorf("Expected only fast to remain, got %+v", servers)
+	}
+}
+
+func TestDrainServerCanceled(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "slow", Address: strings.TrimPrefix(slow.URL, "http://"), IsHealthy: true})
+
+	go lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+	waitForRIF(t, lb, "slow", 1)
+
+	done := make(chan error)
+	go func() {
+		_, err := lb.DrainServer(context.Background(), "slow")
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	lb.SetServerState("slow", loadbalancer.ServerActive)
+
+	if err := <-done; !errors.Is(err, loadbalancer.ErrDrainCanceled) {
+		t.Errorf("Expected ErrDrainCanceled, got %v", err)
+	}
+	if len(lb.Servers()) != 1 {
+		t.Error("Expected a canceled drain to keep the server")
+	}
+}
+
+func TestDrainServerUnderLoad(t *testing.T) {
+	var drained atomic.Bool
+	late := make(chan struct{}, 1)
+	draining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if drained.Load() {
+			select {
+			case late <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	defer draining.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "draining", Address: strings.TrimPrefix(draining.URL, "http://"), IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "other", Address: strings.TrimPrefix(other.URL, "http://"), IsHealthy: true})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := httptest.NewRecorder()
+				lb.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local/", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("Expected every request to be served during the drain, got %d", rec.Code)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := lb.DrainServer(context.Background(), "draining"); err != nil {
+		t.Fatalf("Expected the drain to complete, got %v", err)
+	}
+	// A request counted against the server holds the drain until it finishes,
+	// so nothing can reach the server once it has been removed.
+	drained.Store(true)
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	select {
+	case <-late:
+		t.Error("Expected no request to reach the server after its drain completed")
+	default:
+	}
+}
@@ -0,0 +1,162 @@
+package unit
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestForwardRequestHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Server", "backend")
+	}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Headers: loadbalancer.HeaderConfig{
+			InstanceID: "lb-1",
+			Request: []loadbalancer.HeaderRule{
+				{Action: loadbalancer.HeaderSet, Name: "X-LB-Instance", Value: "{instance_id}"},
+				{Action: loadbalancer.HeaderAdd, Name: "X-Client", Value: "{client_ip}->{server_id}"},
+				{Action: loadbalancer.HeaderRemove, Name: "X-Internal"},
+			},
+			Response: []loadbalancer.HeaderRule{
+				{Action: loadbalancer.HeaderSet, Name: "X-Upstream", Value: "{server_id}"},
+				{Action: loadbalancer.HeaderRemove, Name: "Server"},
+			},
+		},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{
+		ID:        "backend-1",
+		Address:   strings.TrimPrefix(backend.URL, "http://"),
+		IsHealthy: true,
+	})
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.RemoteAddr = "203.0.113.7:5555"
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Host":  "app.example.com",
+		"X-Forwarded-Proto": "http",
+		"Forwarded":         "for=203.0.113.7;host=app.example.com;proto=http",
+		"X-Lb-Instance":     "lb-1",
+		"X-Client":          "203.0.113.7->backend-1",
+		"X-Internal":        "",
+		"X-Hop":             "",
+	}
+	for name, want := range expected {
+		if got := received.Get(name); got != want {
+			t.Errorf("Backend header %s = %q, expected %q", name, got, want)
+		}
+	}
+
+	if got := rec.Header().Get("X-Upstream"); got != "backend-1" {
+		t.Errorf("Expected X-Upstream response header, got %q", got)
+	}
+	if got := rec.Header().Get("Server"); got != "" {
+		t.Errorf("Expected Server response header to be removed, got %q", got)
+	}
+}
+
+func TestForwardedHeadersTrust(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Headers:          loadbalancer.HeaderConfig{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "backend", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+
+	forward := func(remoteAddr string) {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Forwarded", "for=198.51.100.1;proto=https")
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// A client can't vouch for addresses, so what it sends is replaced.
+	forward("203.0.113.7:5555")
+	expected := map[string]string{
+		"Forwarded":         "for=203.0.113.7;host=app.example.com;proto=http",
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Proto": "http",
+	}
+	for name, want := range expected {
+		if got := received.Get(name); got != want {
+			t.Errorf("Untrusted peer: backend header %s = %q, expected %q", name, got, want)
+		}
+	}
+
+	forward("10.1.2.3:5555")
+	expected = map[string]string{
+		"Forwarded":         "for=198.51.100.1;proto=https, for=10.1.2.3;host=app.example.com;proto=http",
+		"X-Forwarded-For":   "198.51.100.1, 10.1.2.3",
+		"X-Forwarded-Proto": "https",
+	}
+	for name, want := range expected {
+		if got := received.Get(name); got != want {
+			t.Errorf("Trusted proxy: backend header %s = %q, expected %q", name, got, want)
+		}
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Request-ID")
+		w.Header().Set("X-Request-ID", "backend-generated")
+	}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{
+		ID:        "backend-1",
+		Address:   strings.TrimPrefix(backend.URL, "http://"),
+		IsHealthy: true,
+	})
+
+	req := httptest.NewRequest("GET", "http://lb.local/", nil)
+	req.Header.Set("X-Request-ID", "client-id-123")
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+
+	if received != "client-id-123" {
+		t.Errorf("Expected backend to receive client request ID, got %q", received)
+	}
+	if got := rec.Header().Values("X-Request-ID"); len(got) != 1 || got[0] != "client-id-123" {
+		t.Errorf("Expected response request ID client-id-123, got %v", got)
+	}
+
+	req = httptest.NewRequest("GET", "http://lb.local/", nil)
+	rec = httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+
+	generated := rec.Header().Get("X-Request-ID")
+	if len(generated) != 32 || generated != received {
+		t.Errorf("Expected generated request ID to reach backend and client, got %q and %q", received, generated)
+	}
+}
@@ -0,0 +1,161 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+// buildLBCtl builds the lbctl binary and returns a function that runs it with
+// args, returning its stdout, stderr and exit code.
+func buildLBCtl(t *testing.T) func(args ...string) (string, string, int) {
+	t.Helper()
+	binary := filepath.Join(t.TempDir(), "lbctl")
+	build := exec.Command("go", "build", "-o", binary, "github.com/omarshaarawi/loadbalancer/cmd/lbctl")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build lbctl: %v\n%s", err, output)
+	}
+
+	return func(args ...string) (string, string, int) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(binary, args...)
+		cmd.Env = append(os.Environ(), "LBCTL_ADDR=")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return stdout.String(), stderr.String(), exitErr.ExitCode()
+		}
+		if err != nil {
+			t.Fatalf("Failed to run lbctl: %v", err)
+		}
+		return stdout.String(), stderr.String(), 0
+	}
+}
+
+// newLBCtlAdmin serves the admin API of a load balancer with one server, both
+// at the root and under /pools/api/ as the server does for pools.
+func newLBCtlAdmin(t *testing.T) (*loadbalancer.LoadBalancer, string) {
+	t.Helper()
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "a", Address: "localhost:8081", Weight: 2, IsHealthy: true})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", lb.AdminHandler())
+	mux.Handle("/pools/api/", http.StripPrefix("/pools/api", lb.AdminHandler()))
+	admin := httptest.NewServer(mux)
+	t.Cleanup(admin.Close)
+	return lb, admin.URL
+}
+
+func TestLBCtlArguments(t *testing.T) {
+	lbctl := buildLBCtl(t)
+	_, addr := newLBCtlAdmin(t)
+
+	tests := []struct {
+		args   []string
+		code   int
+		stderr string
+	}{
+		{nil, 2, "Usage: lbctl"},
+		{[]string{"-addr", addr, "-o", "yaml", "list"}, 2, `unknown output format "yaml"`},
+		{[]string{"-addr", addr, "frobnicate"}, 1, `unknown command "frobnicate"`},
+		{[]string{"-addr", addr, "list", "extra"}, 1, "usage: lbctl list"},
+		{[]string{"-addr", addr, "add", "b"}, 1, "usage: lbctl add <id> <address> [weight]"},
+		{[]string{"-addr", addr, "add", "b", "localhost:8082", "heavy"}, 1, `invalid weight "heavy"`},
+		{[]string{"-addr", addr, "weight", "a"}, 1, "usage: lbctl weight <id> <weight>"},
+		{[]string{"-addr", addr, "drain", "a", "soon"}, 1, `invalid timeout "soon"`},
+		{[]string{"-addr", addr, "state", "a", "paused"}, 1, "paused"},
+		{[]string{"-addr", addr, "weight", "missing", "2"}, 1, "404 Not Found"},
+		{[]string{"-addr", addr, "-pool", "web", "list"}, 1, "404 Not Found"},
+		{[]string{"validate", writeConfig(t, "bad.json", `{"port": "0", "qrif": 2}`)}, 1, "problems in"},
+		{[]string{"validate", writeConfig(t, "log.json", `{"port": "0", "access_log": {"enabled": true, "output": "/nonexistent/access.log"}}`)}, 1, "1 problems in"},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := lbctl(tt.args...)
+		if code != tt.code || !strings.Contains(stderr, tt.stderr) {
+			t.Errorf("lbctl %v: expected exit %d with %q, got %d with %q", tt.args, tt.code, tt.stderr, code, stderr)
+		}
+		if stdout != "" && tt.args[0] != "validate" {
+			t.Errorf("lbctl %v: expected no output, got %q", tt.args, stdout)
+		}
+	}
+}
+
+func TestLBCtlOutput(t *testing.T) {
+	lbctl := buildLBCtl(t)
+	lb, addr := newLBCtlAdmin(t)
+
+	stdout, stderr, code := lbctl("-addr", addr, "list")
+	if code != 0 {
+		t.Fatalf("Expected list to succeed, got %d: %s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || strings.Join(strings.Fields(lines[0]), " ") != "ID ADDRESS HEALTHY STATE WEIGHT RIF LATENCY" {
+		t.Fatalf("Expected a header and one row, got %q", stdout)
+	}
+	if got := strings.Join(strings.Fields(lines[1]), " "); got != "a localhost:8081 true active 2 0 0ms" {
+		t.Errorf("Unexpected row %q", got)
+	}
+
+	stdout, _, code = lbctl("-addr", addr, "-pool", "api", "-o", "json", "add", "b", "localhost:8082", "3")
+	var added loadbalancer.ServerInfo
+	if err := json.Unmarshal([]byte(stdout), &added); err != nil || code != 0 {
+		t.Fatalf("Expected add to print the server as JSON, got %d and %q", code, stdout)
+	}
+	if added.ID != "b" || added.Weight != 3 || added.State != loadbalancer.ServerActive {
+		t.Errorf("Unexpected added server: %+v", added)
+	}
+
+	stdout, _, _ = lbctl("-addr", strings.TrimPrefix(addr, "http://"), "-o", "json", "list")
+	var servers []loadbalancer.ServerInfo
+	if err := json.Unmarshal([]byte(stdout), &servers); err != nil {
+		t.Fatalf("Failed to decode list output %q: %v", stdout, err)
+	}
+	if len(servers) != 2 || servers[1].ID != "b" {
+		t.Errorf("Expected the JSON list to include b, got %+v", servers)
+	}
+
+	if stdout, _, _ = lbctl("-addr", addr, "algorithm", "roundrobin"); stdout != "roundrobin\n" {
+		t.Errorf("Expected the new algorithm to be printed, got %q", stdout)
+	}
+	if lb.Algorithm() != loadbalancer.AlgorithmRoundRobin {
+		t.Errorf("Expected the algorithm to be switched, got %s", lb.Algorithm())
+	}
+
+	stdout, _, _ = lbctl("-addr", addr, "-o", "json", "remove", "b")
+	var removed map[string]string
+	if err := json.Unmarshal([]byte(stdout), &removed); err != nil || removed["removed"] != "b" {
+		t.Errorf("Expected remove to report b as JSON, got %q", stdout)
+	}
+	if stdout, _, _ = lbctl("-addr", addr, "remove", "a"); stdout != "Removed a\n" {
+		t.Errorf("Expected remove to confirm in table mode, got %q", stdout)
+	}
+	if len(lb.Servers()) != 0 {
+		t.Errorf("Expected both servers to be removed, got %+v", lb.Servers())
+	}
+
+	accessLog := filepath.Join(t.TempDir(), "access.log")
+	path := writeConfig(t, "config.json", `{"port": "8080", "servers": [{"id": "a", "address": "localhost:8081"}],
+		"access_log": {"enabled": true, "output": "`+accessLog+`"}}`)
+	if stdout, _, code = lbctl("validate", path); code != 0 || stdout != path+" is valid\n" {
+		t.Errorf("Expected %s to be valid, got %d and %q", path, code, stdout)
+	}
+	if _, err := os.Stat(accessLog); !os.IsNotExist(err) {
+		t.Errorf("Expected validate not to create the access log, got %v", err)
+	}
+}
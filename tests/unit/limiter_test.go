@@ -0,0 +1,110 @@
+package unit
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestConcurrencyLimiterRejectsOverLimit(t *testing.T) {
+	limiter := loadbalancer.NewConcurrencyLimiter(loadbalancer.ConcurrencyLimitConfig{
+		Algorithm:    loadbalancer.LimitAlgorithmAIMD,
+		InitialLimit: 2,
+	})
+
+	if !limiter.Acquire() || !limiter.Acquire() {
+		t.Fatal("Expected first two requests to be admitted")
+	}
+	if limiter.Acquire() {
+		t.Error("Expected third request to be rejected")
+	}
+}
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	limiter := loadbalancer.NewConcurrencyLimiter(loadbalancer.ConcurrencyLimitConfig{
+		Algorithm:    loadbalancer.LimitAlgorithmAIMD,
+		InitialLimit: 10,
+	})
+
+	for i := 0; i < 5; i++ {
+		limiter.Acquire()
+	}
+	limiter.Release(10*time.Millisecond, false)
+	if got := limiter.Limit(); got != 11 {
+		t.Errorf("Expected limit to grow to 11, got %d", got)
+	}
+
+	limiter.Release(10*time.Millisecond, true)
+	if got := limiter.Limit(); got >= 11 {
+		t.Errorf("Expected limit to back off after a drop, got %d", got)
+	}
+}
+
+func TestConcurrencyLimiterGradientBacksOffWhenQueueing(t *testing.T) {
+	limiter := loadbalancer.NewConcurrencyLimiter(loadbalancer.ConcurrencyLimitConfig{
+		Algorithm:    loadbalancer.LimitAlgorithmGradient,
+		InitialLimit: 100,
+		Smoothing:    1,
+	})
+
+	for i := 0; i < 100; i++ {
+		limiter.Acquire()
+	}
+	limiter.Release(10*time.Millisecond, false)
+	for i := 0; i < 10; i++ {
+		limiter.Acquire()
+		limiter.Release(40*time.Millisecond, false)
+	}
+
+	if got := limiter.Limit(); got >= 100 {
+		t.Errorf("Expected limit to shrink when RTT grows, got %d", got)
+	}
+}
+
+func TestConcurrencyLimiterReleasesAbortedRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			// Promise more body than is sent, then drop the connection.
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		ConcurrencyLimit: loadbalancer.ConcurrencyLimitConfig{Algorithm: loadbalancer.LimitAlgorithmAIMD, InitialLimit: 1},
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "backend", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+	front := httptest.NewServer(lb)
+	defer front.Close()
+
+	for range 3 {
+		resp, err := http.Get(front.URL + "/abort")
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	resp, err := http.Get(front.URL + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected aborted requests to free their limiter slots, got %d", resp.StatusCode)
+	}
+	if stats := lb.Stats(); stats.FailedRequests != 3 || stats.SuccessfulRequests != 1 {
+		t.Errorf("Expected 3 failed and 1 successful request, got %d and %d", stats.FailedRequests, stats.SuccessfulRequests)
+	}
+}
@@ -0,0 +1,300 @@
+package unit
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func backendRequestSeries(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	series := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "lb_backend_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var serverID string
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "server_id" {
+					serverID = label.GetValue()
+				}
+			}
+			series[serverID] += metric.GetCounter().GetValue()
+		}
+	}
+	return series
+}
+
+// metricValue sums the series of the named metric that carry all of labels.
+func metricValue(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	var total float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	series:
+		for _, metric := range family.GetMetric() {
+			values := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				values[label.GetName()] = label.GetValue()
+			}
+			for key, value := range labels {
+				if values[key] != value {
+					continue series
+				}
+			}
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	return total
+}
+
+func TestBackendMetrics(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer ok.Close()
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fail.Close()
+	down := httptest.NewServer(nil)
+	down.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	registry := prometheus.NewRegistry()
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Timeouts:  loadbalancer.TimeoutConfig{Default: 50 * time.Millisecond},
+		Metrics:   loadbalancer.MetricsConfig{Registerer: registry},
+	}, slog.Default())
+	// Round robin visits the servers in the order they were added.
+	for _, server := range []struct {
+		id      string
+		backend *httptest.Server
+	}{{"ok", ok}, {"fail", fail}, {"down", down}, {"slow", slow}} {
+		lb.AddServer(&loadbalancer.Server{ID: server.id, Address: strings.TrimPrefix(server.backend.URL, "http://"), IsHealthy: true})
+	}
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://lb.local/", strings.NewReader("ping")))
+	for range 3 {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labels map[string]string
+	}{
+		{"backend_requests_total", map[string]string{"server_id": "ok", "algorithm": "roundrobin", "method": "POST", "status_class": "2xx"}},
+		{"backend_requests_total", map[string]string{"server_id": "fail", "method": "GET", "status_class": "5xx"}},
+		{"backend_requests_total", map[string]string{"server_id": "down", "method": "GET", "status_class": "error"}},
+		{"backend_requests_total", map[string]string{"server_id": "slow", "method": "GET", "status_class": "error"}},
+		{"backend_errors_total", map[string]string{"server_id": "down", "cause": "dial"}},
+		{"backend_errors_total", map[string]string{"server_id": "slow", "cause": "timeout"}},
+	} {
+		if got := metricValue(t, registry, tc.name, tc.labels); got != 1 {
+			t.Errorf("Expected 1 for %s%v, got %v", tc.name, tc.labels, got)
+		}
+	}
+	if got := metricValue(t, registry, "backend_bytes_sent_total", map[string]string{"server_id": "ok"}); got != 4 {
+		t.Errorf("Expected 4 bytes sent to ok, got %v", got)
+	}
+	if got := metricValue(t, registry, "backend_bytes_received_total", map[string]string{"server_id": "ok"}); got != 5 {
+		t.Errorf("Expected 5 bytes received from ok, got %v", got)
+	}
+	if got := metricValue(t, registry, "selections_total", map[string]string{"algorithm": "roundrobin", "outcome": "cold"}); got != 4 {
+		t.Errorf("Expected 4 cold selections, got %v", got)
+	}
+
+	for _, id := range []string{"ok", "fail", "down", "slow"} {
+		lb.RemoveServer(id)
+	}
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+	if got := metricValue(t, registry, "selections_total", map[string]string{"outcome": "no_server"}); got != 1 {
+		t.Errorf("Expected 1 selection without a server, got %v", got)
+	}
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	registries := make([]*prometheus.Registry, 2)
+	balancers := make([]*loadbalancer.LoadBalancer, 2)
+	for i := range balancers {
+		registries[i] = prometheus.NewRegistry()
+		balancers[i] = loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+			SelectionChoices: 2,
+			Metrics: loadbalancer.MetricsConfig{
+				Registerer:  registries[i],
+				Namespace:   "lb",
+				ConstLabels: prometheus.Labels{"instance_name": "test"},
+			},
+		}, slog.Default())
+		balancers[i].AddServer(&loadbalancer.Server{
+			ID:        "backend",
+			Address:   strings.TrimPrefix(backend.URL, "http://"),
+			IsHealthy: true,
+		})
+	}
+
+	balancers[0].ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+
+	if got := backendRequestSeries(t, registries[0])["backend"]; got != 1 {
+		t.Errorf("Expected 1 request in the first registry, got %v", got)
+	}
+	if got := backendRequestSeries(t, registries[1])["backend"]; got != 0 {
+		t.Errorf("Expected 0 requests in the second registry, got %v", got)
+	}
+
+	if !balancers[0].RemoveServer("backend") {
+		t.Fatal("Expected RemoveServer to find the server")
+	}
+	if balancers[0].RemoveServer("backend") {
+		t.Error("Expected second RemoveServer to report false")
+	}
+	if _, ok := backendRequestSeries(t, registries[0])["backend"]; ok {
+		t.Error("Expected series for the removed server to be deleted")
+	}
+	if balancers[0].SelectServer() != nil {
+		t.Error("Expected no server to be selected after removal")
+	}
+}
+
+func TestMetricsSharedRegistry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	registry := prometheus.NewRegistry()
+	newLB := func(pool string) *loadbalancer.LoadBalancer {
+		lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+			SelectionChoices: 2,
+			Metrics: loadbalancer.MetricsConfig{
+				Registerer:  registry,
+				ConstLabels: prometheus.Labels{"lb_pool": pool},
+			},
+		}, slog.Default())
+		lb.AddServer(&loadbalancer.Server{
+			ID:        "backend",
+			Address:   strings.TrimPrefix(backend.URL, "http://"),
+			IsHealthy: true,
+		})
+		return lb
+	}
+
+	api, web := newLB("api"), newLB("web")
+	api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+	web.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+	web.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+
+	if got := metricValue(t, registry, "backend_requests_total", map[string]string{"lb_pool": "api"}); got != 1 {
+		t.Errorf("Expected 1 request for the api pool, got %v", got)
+	}
+	if got := metricValue(t, registry, "backend_requests_total", map[string]string{"lb_pool": "web"}); got != 2 {
+		t.Errorf("Expected 2 requests for the web pool, got %v", got)
+	}
+
+	api.RemoveServer("backend")
+	if got := metricValue(t, registry, "backend_requests_total", map[string]string{"lb_pool": "web", "server_id": "backend"}); got != 2 {
+		t.Errorf("Expected removing a server from one pool to keep the other's series, got %v", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering the same labels twice to panic")
+		}
+	}()
+	newLB("api")
+}
+
+func TestMetricsDefaultRegistry(t *testing.T) {
+	for range 2 {
+		lb := loadbalancer.NewLoadBalancer(nil, slog.Default())
+		lb.AddServer(&loadbalancer.Server{ID: "backend", Address: "localhost:8081", IsHealthy: true})
+		lb.RemoveServer("backend")
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather the default registry: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "server_rif" {
+			t.Error("Expected load balancers without a registerer to leave the default registry alone")
+		}
+	}
+}
+
+func TestProbePool(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		ProbeInterval:    10 * time.Millisecond,
+		ProbeTimeout:     time.Second,
+		HealthCheckPath:  "/health",
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "up", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "down", Address: strings.TrimPrefix(down.URL, "http://"), IsHealthy: true})
+	lb.StartProbing()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(lb.ProbePool()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < 20; i++ {
+		lb.SelectServer()
+	}
+
+	rec := httptest.NewRecorder()
+	lb.ProbePoolHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/probes", nil))
+
+	var pool map[string]loadbalancer.ProbeSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &pool); err != nil {
+		t.Fatalf("Failed to decode probe pool: %v", err)
+	}
+	if len(pool) != 2 {
+		t.Fatalf("Expected 2 probe results, got %d", len(pool))
+	}
+	if !pool["up"].IsHealthy || pool["up"].Error != "" {
+		t.Errorf("Expected healthy probe for up, got %+v", pool["up"])
+	}
+	if pool["down"].IsHealthy || pool["down"].Error == "" {
+		t.Errorf("Expected failed probe with an error for down, got %+v", pool["down"])
+	}
+	if pool["up"].Uses == 0 {
+		t.Error("Expected the selection to use the probe for up")
+	}
+}
@@ -0,0 +1,195 @@
+package unit
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/internal/config"
+	"github.com/omarshaarawi/loadbalancer/internal/server"
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestSetServers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	address := strings.TrimPrefix(slow.URL, "http://")
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "kept", Address: address, IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "moved", Address: "localhost:8082", IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "dropped", Address: "localhost:8083", IsHealthy: true})
+	lb.SetServerState("moved", loadbalancer.ServerDisabled)
+	lb.SetServerState("dropped", loadbalancer.ServerDisabled)
+
+	go lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+	waitForRIF(t, lb, "kept", 1)
+
+	diff, err := lb.SetServers("", []*loadbalancer.Server{
+		{ID: "kept", Address: address, Weight: 3, IsHealthy: true},
+		{ID: "moved", Address: "localhost:9082", IsHealthy: true},
+		{ID: "added", Address: "localhost:8084", IsHealthy: true},
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("SetServers failed: %v", err)
+	}
+	if len(diff.Added) != 1 || len(diff.Removed) != 1 || len(diff.Replaced) != 1 || len(diff.Updated) != 1 {
+		t.Errorf("Unexpected diff: %+v", diff)
+	}
+
+	servers := make(map[string]loadbalancer.ServerInfo)
+	for _, server := range lb.Servers() {
+		servers[server.ID] = server
+	}
+	if kept := servers["kept"]; kept.RIF != 1 || kept.Weight != 3 {
+		t.Errorf("Expected kept to keep its RIF and take the new weight, got %+v", kept)
+	}
+	if moved := servers["moved"]; moved.Address != "localhost:9082" || moved.State != loadbalancer.ServerDisabled {
+		t.Errorf("Expected moved to be replaced and stay disabled, got %+v", moved)
+	}
+
+	// dropped had no requests in flight, so its drain finishes at once.
+	deadline := time.Now().Add(time.Second)
+	for len(lb.Servers()) != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(lb.Servers()) != 3 {
+		t.Errorf("Expected dropped to be drained and removed, got %+v", lb.Servers())
+	}
+
+	if _, err := lb.SetServers("", []*loadbalancer.Server{
+		{ID: "kept", Address: address},
+		{ID: "kept", Address: "localhost:8085"},
+	}, 0); err == nil {
+		t.Error("Expected duplicate IDs to be rejected")
+	}
+	if len(lb.Servers()) != 3 {
+		t.Error("Expected a rejected SetServers to change nothing")
+	}
+}
+
+func TestSetServersKeepsAdminChanges(t *testing.T) {
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	configServers := func() []*loadbalancer.Server {
+		return []*loadbalancer.Server{
+			{ID: "a", Address: "localhost:8081", IsHealthy: true},
+			{ID: "b", Address: "localhost:8082", IsHealthy: true},
+		}
+	}
+	if _, err := lb.SetServers("", configServers(), time.Second); err != nil {
+		t.Fatalf("SetServers failed: %v", err)
+	}
+
+	admin := lb.AdminHandler()
+	if rec := adminRequest(t, admin, "POST", "/servers", `{"id": "extra", "address": "localhost:8083"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected extra to be added, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, admin, "PUT", "/servers/a/state", `{"state": "draining"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a to be marked draining, got %d: %s", rec.Code, rec.Body)
+	}
+
+	diff, err := lb.SetServers("", configServers(), time.Second)
+	if err != nil {
+		t.Fatalf("SetServers failed: %v", err)
+	}
+	if !diff.Empty() {
+		t.Errorf("Expected an unchanged config to change nothing, got %+v", diff)
+	}
+
+	servers := make(map[string]loadbalancer.ServerInfo)
+	for _, server := range lb.Servers() {
+		servers[server.ID] = server
+	}
+	if _, ok := servers["extra"]; !ok {
+		t.Errorf("Expected the server added through the admin API to survive the reload, got %+v", lb.Servers())
+	}
+	if a := servers["a"]; a.State != loadbalancer.ServerDraining {
+		t.Errorf("Expected a to stay draining, got %s", a.State)
+	}
+
+	if _, err := lb.SetServers("", append(configServers(), &loadbalancer.Server{ID: "extra", Address: "localhost:8083"}), 0); err == nil {
+		t.Error("Expected config not to take over a server added through the admin API")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	servers := func() []*loadbalancer.Server {
+		return []*loadbalancer.Server{{ID: "a", Address: "localhost:8081", IsHealthy: true}}
+	}
+	settings := loadbalancer.PoolSettings{
+		Algorithm:        loadbalancer.AlgorithmRoundRobin,
+		SelectionChoices: 3,
+		ProbeInterval:    time.Second,
+		ProbeTimeout:     0,
+	}
+
+	if _, err := lb.Reconfigure(settings, "", servers(), 0); err == nil {
+		t.Fatal("Expected a zero probe timeout to be rejected")
+	}
+	if lb.Algorithm() != loadbalancer.AlgorithmPrequal || len(lb.Servers()) != 0 {
+		t.Errorf("Expected a rejected Reconfigure to change nothing, got %s with %+v", lb.Algorithm(), lb.Servers())
+	}
+
+	settings.ProbeTimeout = time.Second
+	diff, err := lb.Reconfigure(settings, "", servers(), 0)
+	if err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	if lb.Algorithm() != loadbalancer.AlgorithmRoundRobin || len(diff.Added) != 1 || len(lb.Servers()) != 1 {
+		t.Errorf("Expected the algorithm and servers to change together, got %s and %+v", lb.Algorithm(), diff)
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	newConfig := func(servers ...config.ServerConfig) *config.Config {
+		cfg := &config.Config{Port: "0", Servers: servers}
+		cfg.SetDefaults()
+		return cfg
+	}
+
+	srv, err := server.NewServer(newConfig(config.ServerConfig{ID: "a", Address: "localhost:8081"}), slog.Default())
+	if err != nil {
+		t.Fatalf("Failed to build server: %v", err)
+	}
+
+	next := newConfig(config.ServerConfig{ID: "a", Address: "localhost:8081", Weight: 2}, config.ServerConfig{ID: "b", Address: "localhost:8082"})
+	next.Algorithm = "roundrobin"
+	if err := srv.Reload(next); err != nil {
+		t.Errorf("Expected the reload to succeed, got %v", err)
+	}
+
+	invalid := newConfig(config.ServerConfig{ID: "a", Address: "no-port"})
+	if err := srv.Reload(invalid); err == nil {
+		t.Error("Expected an invalid config to be rejected")
+	}
+
+	policy := newConfig(config.ServerConfig{ID: "a", Address: "localhost:8081"})
+	policy.Retry = &config.RetryConfig{MaxRetries: 2}
+	if err := srv.Reload(policy); err == nil {
+		t.Error("Expected a change of request handling settings to be rejected")
+	}
+
+	pools := newConfig()
+	pools.Pools = []config.PoolConfig{{Name: "api"}}
+	pools.SetDefaults()
+	if err := srv.Reload(pools); err == nil {
+		t.Error("Expected a change of pools to be rejected")
+	}
+}
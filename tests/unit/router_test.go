@@ -0,0 +1,223 @@
+package unit
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func newBackend(t *testing.T, id string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", id)
+		w.Header().Set("X-Path", r.URL.Path)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func newPool(t *testing.T, id string) *loadbalancer.LoadBalancer {
+	t.Helper()
+	backend := newBackend(t, id)
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{
+		ID:        id,
+		Address:   strings.TrimPrefix(backend.URL, "http://"),
+		IsHealthy: true,
+	})
+	return lb
+}
+
+func TestRouterRoutesToPools(t *testing.T) {
+	router := loadbalancer.NewRouter(slog.Default())
+	router.AddPool("api", newPool(t, "api-1"))
+	router.AddPool("web", newPool(t, "web-1"))
+
+	routes := []loadbalancer.Route{
+		{Name: "api", Match: loadbalancer.RouteMatch{PathPrefix: "/api", Methods: []string{"GET"}}, Pool: "api", StripPrefix: true},
+		{Name: "admin", Match: loadbalancer.RouteMatch{Host: "*.example.com", PathRegex: `^/v(\d+)/(.*)$`}, Pool: "api", RewritePath: "/$2"},
+		{Name: "web", Pool: "web"},
+	}
+	for _, route := range routes {
+		if err := router.AddRoute(route); err != nil {
+			t.Fatalf("AddRoute(%s): %v", route.Name, err)
+		}
+	}
+
+	tests := []struct {
+		method, host, path    string
+		servedBy, backendPath string
+	}{
+		{"GET", "lb.local", "/api/users", "api-1", "/users"},
+		{"POST", "lb.local", "/api/users", "web-1", "/api/users"},
+		{"GET", "admin.example.com:8080", "/v2/users", "api-1", "/users"},
+		{"GET", "lb.local", "/v2/users", "web-1", "/v2/users"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("X-Served-By"); got != tt.servedBy {
+			t.Errorf("%s %s%s: expected %s, got %q", tt.method, tt.host, tt.path, tt.servedBy, got)
+		}
+		if got := rec.Header().Get("X-Path"); got != tt.backendPath {
+			t.Errorf("%s %s%s: expected backend path %s, got %q", tt.method, tt.host, tt.path, tt.backendPath, got)
+		}
+	}
+}
+
+func TestRouterRejectsUnknownPool(t *testing.T) {
+	router := loadbalancer.NewRouter(slog.Default())
+	if err := router.AddRoute(loadbalancer.Route{Name: "missing", Pool: "nope"}); err == nil {
+		t.Error("Expected error for route to unknown pool")
+	}
+}
+
+func TestRouterWeightedSplit(t *testing.T) {
+	router := loadbalancer.NewRouter(slog.Default())
+	router.AddPool("stable", newPool(t, "stable-1"))
+	router.AddPool("canary", newPool(t, "canary-1"))
+
+	err := router.AddRoute(loadbalancer.Route{
+		Name:     "split",
+		Splits:   []loadbalancer.Split{{Pool: "stable", Weight: 100}, {Pool: "canary", Weight: 0}},
+		SplitKey: loadbalancer.SplitKey{Header: "X-User"},
+	})
+	if err != nil {
+		t.Fatalf("AddRoute: %v", err)
+	}
+
+	serve := func(user string) string {
+		req := httptest.NewRequest("GET", "http://lb.local/", nil)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Header().Get("X-Served-By")
+	}
+
+	for i := 0; i < 20; i++ {
+		if got := serve("user-1"); got != "stable-1" {
+			t.Fatalf("Expected all traffic on stable, got %q", got)
+		}
+	}
+
+	if err := router.SetSplitWeights("split", map[string]int{"stable": 50, "canary": 50}); err != nil {
+		t.Fatalf("SetSplitWeights: %v", err)
+	}
+
+	first := serve("user-2")
+	for i := 0; i < 20; i++ {
+		if got := serve("user-2"); got != first {
+			t.Fatalf("Expected user to stay on %s, got %s", first, got)
+		}
+	}
+
+	if err := router.SetSplitWeights("split", map[string]int{"unknown": 1}); err == nil {
+		t.Error("Expected error for unknown split pool")
+	}
+}
+
+func TestRouterSplitWeightsUnderTraffic(t *testing.T) {
+	router := loadbalancer.NewRouter(slog.Default())
+	router.AddPool("stable", newPool(t, "stable-1"))
+	router.AddPool("canary", newPool(t, "canary-1"))
+	err := router.AddRoute(loadbalancer.Route{
+		Name:   "split",
+		Splits: []loadbalancer.Split{{Pool: "stable", Weight: 90}, {Pool: "canary", Weight: 10}},
+	})
+	if err != nil {
+		t.Fatalf("AddRoute: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.local/", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("Expected 200 while weights change, got %d", rec.Code)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for i := 0; ; i = (i + 1) % 100 {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err := router.SetSplitWeights("split", map[string]int{"stable": 100 - i, "canary": i}); err != nil {
+			t.Errorf("SetSplitWeights: %v", err)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+func TestRouterMirrorsRequests(t *testing.T) {
+	received := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer shadow.Close()
+
+	shadowLB := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	shadowLB.AddServer(&loadbalancer.Server{
+		ID:        "shadow-1",
+		Address:   strings.TrimPrefix(shadow.URL, "http://"),
+		IsHealthy: true,
+	})
+
+	router := loadbalancer.NewRouter(slog.Default())
+	router.AddPool("live", newPool(t, "live-1"))
+	router.AddPool("shadow", shadowLB)
+	err := router.AddRoute(loadbalancer.Route{
+		Name:   "mirrored",
+		Pool:   "live",
+		Mirror: &loadbalancer.MirrorConfig{Pool: "shadow", Percent: 100},
+	})
+	if err != nil {
+		t.Fatalf("AddRoute: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "http://lb.local/orders", strings.NewReader("payload"))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Served-By"); got != "live-1" {
+		t.Errorf("Expected live response, got %q", got)
+	}
+
+	select {
+	case body := <-received:
+		if body != "payload" {
+			t.Errorf("Expected shadow to receive the request body, got %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Shadow request was not sent")
+	}
+}
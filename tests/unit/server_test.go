@@ -0,0 +1,84 @@
+package unit
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omarshaarawi/loadbalancer/internal/config"
+	"github.com/omarshaarawi/loadbalancer/internal/server"
+)
+
+func TestNewServerWithPools(t *testing.T) {
+	cfg := &config.Config{
+		Port:             "0",
+		SelectionChoices: 2,
+		Pools: []config.PoolConfig{
+			{Name: "stable", SelectionChoices: 2, Servers: []config.ServerConfig{{ID: "s1", Address: "localhost:8081"}}},
+			{Name: "canary", SelectionChoices: 2, Servers: []config.ServerConfig{{ID: "c1", Address: "localhost:8082"}}},
+		},
+		Routes: []config.RouteConfig{
+			{Name: "api", Splits: []config.SplitConfig{{Pool: "stable", Weight: 90}, {Pool: "canary", Weight: 10}}},
+		},
+	}
+
+	if _, err := server.NewServer(cfg, slog.Default()); err != nil {
+		t.Fatalf("Expected the server to build, got %v", err)
+	}
+
+	cfg.Pools[1].Servers = append(cfg.Pools[1].Servers, config.ServerConfig{ID: "c1", Address: "localhost:8083"})
+	if _, err := server.NewServer(cfg, slog.Default()); err == nil {
+		t.Error("Expected a duplicate server ID to be rejected")
+	}
+}
+
+func TestNewServerPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Class", r.Header.Get("X-Class"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Port:    "0",
+		Servers: []config.ServerConfig{{ID: "a", Address: strings.TrimPrefix(backend.URL, "http://")}},
+		PolicyConfig: config.PolicyConfig{
+			Sticky: &config.StickyConfig{Enabled: true, CookieName: "pin", Secret: "secret"},
+			Headers: &config.HeaderConfig{
+				Request:  []config.HeaderRuleConfig{{Action: "set", Name: "X-Class", Value: "{server_id}"}},
+				Response: []config.HeaderRuleConfig{{Action: "set", Name: "X-Upstream", Value: "{server_id}"}},
+			},
+			Debug: &config.DebugConfig{Enabled: true},
+		},
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected the config to be valid, got %v", err)
+	}
+	srv, err := server.NewServer(cfg, slog.Default())
+	if err != nil {
+		t.Fatalf("Failed to build server: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://lb.local/", nil)
+	req.Header.Set("X-LB-Debug", "true")
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Upstream"); got != "a" {
+		t.Errorf("Expected the response header rule to set X-Upstream, got %q", got)
+	}
+	if got := rec.Header().Get("X-Seen-Class"); got != "a" {
+		t.Errorf("Expected the request header rule to reach the backend, got %q", got)
+	}
+	if !strings.Contains(rec.Header().Get("Set-Cookie"), "pin=") {
+		t.Errorf("Expected a sticky cookie named pin, got %q", rec.Header().Get("Set-Cookie"))
+	}
+	if rec.Header().Get("X-LB-Decision") == "" {
+		t.Error("Expected the debug header to return the selection decision")
+	}
+}
@@ -0,0 +1,112 @@
+package unit
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer backend.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 1,
+		Algorithm:        loadbalancer.AlgorithmRoundRobin,
+		Metrics:          loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+
+	lb.AddServer(&loadbalancer.Server{ID: "up", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "down", Address: strings.TrimPrefix(down.URL, "http://"), IsHealthy: true})
+	for i := 0; i < 4; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+	}
+
+	stats := lb.Stats()
+	if stats.TotalRequests != 5 || stats.SuccessfulRequests != 2 || stats.FailedRequests != 3 {
+		t.Errorf("Expected 5 total, 2 successful and 3 failed requests, got %d, %d and %d",
+			stats.TotalRequests, stats.SuccessfulRequests, stats.FailedRequests)
+	}
+	if stats.AverageLatency <= 0 {
+		t.Errorf("Expected a positive average latency, got %v", stats.AverageLatency)
+	}
+
+	window := stats.Windows["1m"]
+	if window.Requests != 5 || window.Failures != 3 {
+		t.Errorf("Expected 5 requests and 3 failures in the 1m window, got %d and %d", window.Requests, window.Failures)
+	}
+	if window.P99 < window.P50 || window.P99 < 0.005 {
+		t.Errorf("Expected p99 >= 5ms and p99 >= p50, got %v and %v", window.P99, window.P50)
+	}
+
+	servers := make(map[string]loadbalancer.ServerStats)
+	for _, server := range stats.Servers {
+		servers[server.ID] = server
+	}
+	if servers["up"].Requests != 2 || servers["up"].Failures != 0 {
+		t.Errorf("Expected 2 requests and no failures for up, got %+v", servers["up"])
+	}
+	if servers["down"].Requests != 2 || servers["down"].Failures != 2 {
+		t.Errorf("Expected 2 failed requests for down, got %+v", servers["down"])
+	}
+
+	rec := httptest.NewRecorder()
+	lb.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var decoded loadbalancer.StatsSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if decoded.TotalRequests != 5 || len(decoded.Servers) != 2 {
+		t.Errorf("Expected status to report 5 requests and 2 servers, got %+v", decoded)
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "a", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "b", Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true})
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://lb.local/", nil))
+				lb.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := lb.Stats()
+	if stats.TotalRequests != 400 || stats.SuccessfulRequests != 400 {
+		t.Errorf("Expected 400 successful requests, got %d of %d", stats.SuccessfulRequests, stats.TotalRequests)
+	}
+	var attempts uint64
+	for _, server := range stats.Servers {
+		attempts += server.Requests
+	}
+	if attempts != 400 {
+		t.Errorf("Expected 400 attempts across the servers, got %d", attempts)
+	}
+}
@@ -0,0 +1,164 @@
+package unit
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func newStickyPool(t *testing.T) (*loadbalancer.LoadBalancer, map[string]*loadbalancer.Server) {
+	t.Helper()
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Sticky: loadbalancer.StickyConfig{
+			Enabled: true,
+			Secret:  []byte("secret"),
+			TTL:     time.Hour,
+			Secure:  true,
+		},
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+
+	servers := make(map[string]*loadbalancer.Server)
+	for _, id := range []string{"a", "b", "c"} {
+		backend := newBackend(t, id)
+		servers[id] = &loadbalancer.Server{ID: id, Address: strings.TrimPrefix(backend.URL, "http://"), IsHealthy: true}
+		lb.AddServer(servers[id])
+	}
+	return lb, servers
+}
+
+func stickyRequest(lb *loadbalancer.LoadBalancer, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://lb.local/", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	return rec
+}
+
+func stickyCookie(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "lb_session" {
+			return cookie
+		}
+	}
+	t.Fatalf("Expected a lb_session cookie, got %v", rec.Header().Values("Set-Cookie"))
+	return nil
+}
+
+func TestStickySessions(t *testing.T) {
+	lb, _ := newStickyPool(t)
+
+	rec := stickyRequest(lb, nil)
+	pinned := rec.Header().Get("X-Served-By")
+	cookie := stickyCookie(t, rec)
+	if cookie.Path != "/" || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge != 3600 {
+		t.Errorf("Unexpected cookie attributes: %+v", cookie)
+	}
+
+	for range 6 {
+		rec := stickyRequest(lb, cookie)
+		if got := rec.Header().Get("X-Served-By"); got != pinned {
+			t.Fatalf("Expected the cookie to pin requests to %s, got %s", pinned, got)
+		}
+		if rec.Header().Get("Set-Cookie") != "" {
+			t.Error("Expected no new cookie while the pinned server serves")
+		}
+	}
+}
+
+func TestStickyFallback(t *testing.T) {
+	lb, servers := newStickyPool(t)
+
+	cookie := stickyCookie(t, stickyRequest(lb, nil))
+	lb.RemoveServer(stickyRequest(lb, cookie).Header().Get("X-Served-By"))
+
+	rec := stickyRequest(lb, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the request to fall back to another server, got %d", rec.Code)
+	}
+	cookie = stickyCookie(t, rec)
+	repinned := rec.Header().Get("X-Served-By")
+	if got := stickyRequest(lb, cookie).Header().Get("X-Served-By"); got != repinned {
+		t.Errorf("Expected the new cookie to pin requests to %s, got %s", repinned, got)
+	}
+
+	servers[repinned].IsHealthy = false
+	rec = stickyRequest(lb, cookie)
+	if got := rec.Header().Get("X-Served-By"); got == repinned || rec.Code != http.StatusOK {
+		t.Errorf("Expected an unhealthy pinned server to be skipped, got %s (%d)", got, rec.Code)
+	}
+	stickyCookie(t, rec)
+}
+
+func TestStickyRejectsTamperedCookie(t *testing.T) {
+	lb, _ := newStickyPool(t)
+
+	cookie := stickyCookie(t, stickyRequest(lb, nil))
+	pinned := stickyRequest(lb, cookie).Header().Get("X-Served-By")
+	target := "a"
+	if pinned == "a" {
+		target = "b"
+	}
+
+	// Point the cookie at another server but keep the old signature.
+	_, signature, _ := strings.Cut(cookie.Value, ".")
+	tampered := &http.Cookie{Name: cookie.Name, Value: base64.RawURLEncoding.EncodeToString([]byte(target)) + "." + signature}
+
+	served := make(map[string]bool)
+	for range 3 {
+		rec := stickyRequest(lb, tampered)
+		served[rec.Header().Get("X-Served-By")] = true
+		if stickyCookie(t, rec).Value == tampered.Value {
+			t.Error("Expected a tampered cookie to be replaced")
+		}
+	}
+	if len(served) == 1 && served[target] {
+		t.Errorf("Expected a tampered cookie not to pin requests to %s", target)
+	}
+}
+
+func TestStickyCookieAfterRetry(t *testing.T) {
+	dead := httptest.NewServer(nil)
+	dead.Close()
+	good := newBackend(t, "good")
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		Algorithm: loadbalancer.AlgorithmRoundRobin,
+		Sticky:    loadbalancer.StickyConfig{Enabled: true},
+		Retry:     loadbalancer.RetryConfig{MaxRetries: 1},
+		Metrics:   loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{ID: "dead", Address: strings.TrimPrefix(dead.URL, "http://"), IsHealthy: true})
+	lb.AddServer(&loadbalancer.Server{ID: "good", Address: strings.TrimPrefix(good.URL, "http://"), IsHealthy: true})
+
+	// Round robin tries dead first, and the retry goes to good.
+	rec := stickyRequest(lb, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Served-By") != "good" {
+		t.Fatalf("Expected the retry to be served by good, got %s (%d)", rec.Header().Get("X-Served-By"), rec.Code)
+	}
+	cookies := rec.Header().Values("Set-Cookie")
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one cookie, got %v", cookies)
+	}
+	for range 4 {
+		if got := stickyRequest(lb, stickyCookie(t, rec)).Header().Get("X-Served-By"); got != "good" {
+			t.Fatalf("Expected the cookie to pin the server that answered, got %s", got)
+		}
+	}
+
+	lb.RemoveServer("good")
+	rec = stickyRequest(lb, nil)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Expected a failed request to set no cookie, got %d with %v", rec.Code, rec.Header().Values("Set-Cookie"))
+	}
+}
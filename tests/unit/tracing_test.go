@@ -0,0 +1,119 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omarshaarawi/loadbalancer/pkg/loadbalancer"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tc, ok := loadbalancer.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || !tc.Sampled {
+		t.Fatal("Expected valid sampled traceparent")
+	}
+	if got := tc.Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Unexpected round trip: %s", got)
+	}
+
+	invalid := []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	}
+	for _, value := range invalid {
+		if _, ok := loadbalancer.ParseTraceparent(value); ok {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+type collectorStub struct {
+	mutex sync.Mutex
+	spans []map[string]any
+}
+
+func (c *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]any `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	json.NewDecoder(r.Body).Decode(&payload)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rs := range payload.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestTracingContinuesTraceparent(t *testing.T) {
+	collector := &collectorStub{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	var upstreamTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+	}))
+	defer backend.Close()
+
+	lb := loadbalancer.NewLoadBalancer(&loadbalancer.Config{
+		SelectionChoices: 2,
+		Tracing: loadbalancer.TracingConfig{
+			Enabled:  true,
+			Endpoint: collectorServer.URL + "/v1/traces",
+		},
+		Metrics: loadbalancer.MetricsConfig{Disabled: true},
+	}, slog.Default())
+	lb.AddServer(&loadbalancer.Server{
+		ID:        "backend-1",
+		Address:   strings.TrimPrefix(backend.URL, "http://"),
+		IsHealthy: true,
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "http://lb.local/", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	lb.ServeHTTP(httptest.NewRecorder(), req)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := lb.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if !strings.HasPrefix(upstreamTraceparent, "00-"+traceID+"-") {
+		t.Errorf("Expected backend to receive trace %s, got %q", traceID, upstreamTraceparent)
+	}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	names := make(map[string]bool)
+	for _, span := range collector.spans {
+		if span["traceId"] != traceID {
+			t.Errorf("Span %v has wrong trace ID %v", span["name"], span["traceId"])
+		}
+		names[span["name"].(string)] = true
+	}
+	for _, name := range []string{"loadbalancer.request", "loadbalancer.select", "loadbalancer.upstream"} {
+		if !names[name] {
+			t.Errorf("Expected span %s to be exported, got %v", name, names)
+		}
+	}
+}